@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Which access status a host gets before any secrets exist, and whether a
+// write command may create the first secrets file
+func TestFirstWriteAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, h *testHost)
+		status  int
+		canSave bool
+	}{
+		{
+			name:   "no hosts, no secrets",
+			setup:  func(t *testing.T, h *testHost) {},
+			status: accessNoSecrets,
+		},
+		{
+			name:    "listed, no secrets",
+			setup:   func(t *testing.T, h *testHost) { h.writeHosts(t, h.pubKey) },
+			status:  accessNoSecrets,
+			canSave: true,
+		},
+		{
+			name: "listed, empty secrets file",
+			setup: func(t *testing.T, h *testHost) {
+				h.writeHosts(t, h.pubKey)
+				writeEmpty(t, secretsFile)
+			},
+			status:  accessNoSecrets,
+			canSave: true,
+		},
+		{
+			name: "empty secrets file, no hosts",
+			setup: func(t *testing.T, h *testHost) {
+				writeEmpty(t, secretsFile)
+			},
+			status: accessNoSecrets,
+		},
+		{
+			name: "not listed, no secrets",
+			setup: func(t *testing.T, h *testHost) {
+				_, other := writeTestKey(t, t.TempDir(), "other", "other")
+				h.writeHosts(t, other)
+			},
+			status: accessNotInHosts,
+		},
+		{
+			name: "listed in hosts.d, empty secrets file",
+			setup: func(t *testing.T, h *testHost) {
+				dir := filepath.Join(h.dir, hostsDirName)
+				if err := os.Mkdir(dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "testhost.pub"), h.pubKey, 0644); err != nil {
+					t.Fatal(err)
+				}
+				writeEmpty(t, secretsFile)
+			},
+			status:  accessNoSecrets,
+			canSave: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHost(t)
+			tt.setup(t, h)
+
+			status, err := hostAccessStatus()
+			if err != nil {
+				t.Fatalf("hostAccessStatus: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("hostAccessStatus = %s, want %s", accessStatusNames[status], accessStatusNames[tt.status])
+			}
+
+			content, err := loadSecretsForUpdate()
+			if tt.canSave {
+				if err != nil {
+					t.Fatalf("loadSecretsForUpdate: %v", err)
+				}
+				if len(content) != 0 {
+					t.Errorf("loadSecretsForUpdate = %q, want nothing", content)
+				}
+			} else {
+				var code exitCode
+				if !errors.As(err, &code) || int(code) != tt.status {
+					t.Errorf("loadSecretsForUpdate error = %v, want exit code %d", err, tt.status)
+				}
+			}
+		})
+	}
+}
+
+// Once the first write has created the secrets file, the host can read it
+func TestFirstWriteCreatesFile(t *testing.T) {
+	for _, empty := range []bool{false, true} {
+		h := newTestHost(t)
+		h.writeHosts(t, h.pubKey)
+		if empty {
+			writeEmpty(t, secretsFile)
+		}
+
+		if _, err := loadSecretsForUpdate(); err != nil {
+			t.Fatalf("loadSecretsForUpdate: %v", err)
+		}
+		if err := encryptSecrets([]byte("FOO=bar\n")); err != nil {
+			t.Fatalf("encryptSecrets: %v", err)
+		}
+		h.use(t, h.key)
+
+		if status, err := hostAccessStatus(); err != nil || status != accessOK {
+			t.Fatalf("hostAccessStatus = %d, %v; want ok", status, err)
+		}
+		content, err := loadSecretsForUpdate()
+		if err != nil {
+			t.Fatalf("loadSecretsForUpdate: %v", err)
+		}
+		if string(content) != "FOO=bar\n" {
+			t.Errorf("secrets = %q, want %q", content, "FOO=bar\n")
+		}
+	}
+}
+
+func writeEmpty(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Commands that rewrite the secrets decrypt once, reusing the plaintext from
+// the access check, rather than once to check access and again to read
+func BenchmarkLoadSecretsForUpdate(b *testing.B) {
+	h := newTestHost(b)
+	h.writeHosts(b, h.pubKey)
+	var content []byte
+	for i := 0; i < 5000; i++ {
+		content = append(content, fmt.Sprintf("KEY_%d=%0100d\n", i, i)...)
+	}
+	if err := encryptSecrets(content); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("decrypt-once", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			plaintext, err := loadSecretsForUpdate()
+			if err != nil {
+				b.Fatal(err)
+			}
+			zero(plaintext)
+		}
+	})
+	b.Run("check-then-decrypt", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := hostAccessStatus(); err != nil {
+				b.Fatal(err)
+			}
+			discardAccessPlaintext()
+			plaintext, err := decryptToBytes()
+			if err != nil {
+				b.Fatal(err)
+			}
+			zero(plaintext)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/shardul/secrets"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An ssh-agent can only sign, while age's SSH recipients need the private
+// key itself to unwrap. Agent keys are instead used to derive a native age
+// identity: the agent signs a fixed challenge and the signature, which is
+// deterministic for Ed25519 and RSA keys, seeds an X25519 key. The matching
+// age1 recipient goes in the hosts file via 'add-this-host --agent'.
+//
+// The challenge is public, so anyone who can use the agent can derive the
+// identity, and once derived it decrypts every secrets file encrypted to it
+// for good. That includes root on any host reached with 'ssh -A', which can
+// use the forwarded socket while the session is open. Only rely on agent
+// identities with agents that are never forwarded to hosts you don't trust,
+// or that confirm each use ('ssh-add -c').
+const agentChallenge = "github.com/shardul/secrets agent identity v1"
+
+// An age identity derived from an ssh-agent key
+type agentIdentity struct {
+	identity *age.X25519Identity
+	comment  string // Comment of the agent key, usually user@host
+}
+
+// Identities derived from the agent, kept for the rest of the process so
+// agent keys added with 'ssh-add -c' only ask for confirmation once
+var (
+	agentIdentities []agentIdentity
+	agentLoaded     bool
+)
+
+// Derive an age identity from every suitable key in $SSH_AUTH_SOCK. No agent
+// is not an error; it just yields no identities.
+func loadAgentIdentities() ([]agentIdentity, error) {
+	if agentLoaded {
+		return agentIdentities, nil
+	}
+	agentLoaded = true
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %w", err)
+	}
+
+	for _, key := range keys {
+		var flags agent.SignatureFlags
+		switch key.Type() {
+		case ssh.KeyAlgoED25519:
+		case ssh.KeyAlgoRSA:
+			flags = agent.SignatureFlagRsaSha256
+		default:
+			// ECDSA and security key signatures differ on every call
+			debugf("skipping ssh-agent key %s: %s signatures aren't deterministic", key.Comment, key.Type())
+			continue
+		}
+
+		sig, err := client.SignWithFlags(key, []byte(agentChallenge), flags)
+		if err != nil {
+			debugf("ssh-agent did not sign with %s: %v", key.Comment, err)
+			continue
+		}
+		seed := sha256.Sum256(append([]byte(agentChallenge), sig.Blob...))
+		identity, err := age.ParseX25519Identity(strings.ToUpper(bech32Encode("age-secret-key-", seed[:])))
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive identity from %s: %w", key.Comment, err)
+		}
+		debugf("using ssh-agent key %s (%s)", key.Comment, identity.Recipient())
+		agentIdentities = append(agentIdentities, agentIdentity{identity: identity, comment: key.Comment})
+	}
+
+	return agentIdentities, nil
+}
+
+// Whether the agent socket is one sshd created for a forwarded agent
+// ('ssh -A'): sshd puts those at /tmp/ssh-XXXXXXXXXX/agent.PID and sets
+// SSH_CONNECTION for the session
+func forwardedAgent(sock string) bool {
+	if os.Getenv("SSH_CONNECTION") == "" {
+		return false
+	}
+	return strings.HasPrefix(filepath.Base(sock), "agent.") && strings.HasPrefix(filepath.Base(filepath.Dir(sock)), "ssh-")
+}
+
+// Set once the forwarded agent warning has been printed
+var warnedForwarded bool
+
+// Warn on stderr that agent identities are in use through a forwarded
+// agent, which every host it's forwarded through could derive too
+func warnForwardedAgent() {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if forwardedAgent(sock) && !warnedForwarded {
+		warnedForwarded = true
+		fmt.Fprintf(os.Stderr, "Warning: using identities derived from a forwarded ssh-agent (%s); root on this host, or any host it's forwarded through, can derive them too\n", sock)
+	}
+}
+
+// Report whether any agent-derived recipient is listed in the hosts file
+func hostsContainAgentRecipient(hostsContent []byte) bool {
+	identities, err := loadAgentIdentities()
+	if err != nil {
+		debugf("%v", err)
+		return false
+	}
+	for _, id := range identities {
+		if hostsContainRecipient(hostsContent, id.identity.Recipient().String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether the hosts file lists the given age1 recipient
+func hostsContainRecipient(hostsContent []byte, recipient string) bool {
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		key, _ := secrets.SplitHostLine(strings.TrimSpace(line))
+		if fields := strings.Fields(key); len(fields) > 0 && fields[0] == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// Append the recipients derived from the agent's keys to the hosts file
+func addAgentHosts() error {
+	identities, err := loadAgentIdentities()
+	if err != nil {
+		return err
+	}
+	if len(identities) == 0 {
+		return errors.New("No usable ssh-agent keys (need an Ed25519 or RSA key in $SSH_AUTH_SOCK)")
+	}
+	warnForwardedAgent()
+
+	if err := makeSecretsDir(); err != nil {
+		return err
+	}
+	hostsContent, err := readFile(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+	// Keys in hosts.d count as authorized, but agent keys are still added
+	// to secrets.hosts, named as they are by their often path-like comments
+	allHosts, err := readHosts(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+
+	added := 0
+	for _, id := range identities {
+		recipient := id.identity.Recipient().String()
+		if hostsContainRecipient(allHosts, recipient) || hostsContainRecipient(hostsContent, recipient) {
+			fmt.Printf("Agent key %s is already authorized\n", id.comment)
+			continue
+		}
+		if len(hostsContent) > 0 && !bytes.HasSuffix(hostsContent, []byte("\n")) {
+			hostsContent = append(hostsContent, '\n')
+		}
+		hostsContent = append(hostsContent, strings.TrimSpace(recipient+" "+id.comment)+"\n"...)
+		fmt.Printf("Agent key %s added as %s\n", id.comment, recipient)
+		approvedGrants[recipient] = true
+		added++
+	}
+
+	if added == 0 {
+		return nil
+	}
+	if err := writeHostsFile(hostsContent); err != nil {
+		return errors.New("Failed to update hosts file")
+	}
+	return revalidateAfterAdd("")
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// Encode data as bech32 (BIP 173), the format of age keys
+func bech32Encode(hrp string, data []byte) string {
+	// Regroup the 8-bit bytes into 5-bit values, padding the last one
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits&31))
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits)&31))
+	}
+
+	var expanded []byte
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	expanded = append(expanded, values...)
+	expanded = append(expanded, 0, 0, 0, 0, 0, 0)
+
+	mod := bech32Polymod(expanded) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(mod>>uint(5*(5-i))&31))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if top>>uint(i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
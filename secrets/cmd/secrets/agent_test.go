@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestForwardedAgent(t *testing.T) {
+	tests := []struct {
+		sock, connection string
+		want             bool
+	}{
+		{"/tmp/ssh-XXXXab12cd/agent.4242", "10.0.0.1 50000 10.0.0.2 22", true},
+		{"/tmp/ssh-XXXXab12cd/agent.4242", "", false},
+		{"/run/user/1000/ssh-agent.socket", "10.0.0.1 50000 10.0.0.2 22", false},
+		{"/Users/me/.1password/agent.sock", "10.0.0.1 50000 10.0.0.2 22", false},
+		{"", "10.0.0.1 50000 10.0.0.2 22", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("SSH_CONNECTION", tt.connection)
+		if got := forwardedAgent(tt.sock); got != tt.want {
+			t.Errorf("forwardedAgent(%q) with SSH_CONNECTION=%q = %v, want %v", tt.sock, tt.connection, got, tt.want)
+		}
+	}
+}
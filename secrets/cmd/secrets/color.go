@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Disable ANSI colors even on a terminal (--no-color, or NO_COLOR set)
+var noColor = os.Getenv("NO_COLOR") != ""
+
+const (
+	ansiBold   = "1"
+	ansiRed    = "31"
+	ansiGreen  = "32"
+	ansiYellow = "33"
+)
+
+// Report whether messages written to f should be colored: only on a
+// terminal that isn't dumb, and never with --no-color or NO_COLOR
+func colorEnabled(f *os.File) bool {
+	return !noColor && os.Getenv("TERM") != "dumb" && term.IsTerminal(int(f.Fd()))
+}
+
+// Wrap s in an ANSI style for writing to f, or return it unchanged when f
+// doesn't get colors
+func colorize(f *os.File, style, s string) string {
+	if !colorEnabled(f) {
+		return s
+	}
+	return "\033[" + style + "m" + s + "\033[0m"
+}
+
+// Styles for the human-facing messages on stdout
+func heading(s string) string  { return colorize(os.Stdout, ansiBold, s) }
+func okText(s string) string   { return colorize(os.Stdout, ansiGreen, s) }
+func badText(s string) string  { return colorize(os.Stdout, ansiRed, s) }
+func noteText(s string) string { return colorize(os.Stdout, ansiYellow, s) }
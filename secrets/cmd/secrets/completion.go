@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Top-level commands offered by shell completion
+var completionCommands = []struct {
+	name        string
+	description string
+}{
+	{"list", "Show raw decrypted secrets"},
+	{"get", "Print the value of one key"},
+	{"grep", "List keys matching a pattern"},
+	{"activate", "Output secrets for shell evaluation"},
+	{"exec", "Run a command with the secrets in its environment"},
+	{"dump-env", "Print KEY=value pairs for direnv"},
+	{"edit", "Edit secrets in $EDITOR"},
+	{"check", "Verify the secrets decrypt and are valid"},
+	{"audit", "Compare the file's recipients with the hosts file"},
+	{"inspect", "List an age file's recipients without decrypting"},
+	{"doctor", "Check the setup and say how to fix problems"},
+	{"set", "Add or update keys"},
+	{"unset", "Remove keys"},
+	{"import", "Merge KEY=value lines from a dotenv file"},
+	{"export", "Write decrypted secrets to a file"},
+	{"decrypt", "Decrypt an age file from stdin to stdout"},
+	{"encrypt", "Encrypt stdin to stdout for every host"},
+	{"add-this-host", "Add current host's key to authorized hosts"},
+	{"hosts", "Authorize another machine by its public key"},
+	{"clone-access", "Give this host the same access as another"},
+	{"revalidate", "Reencrypt secrets with all current host keys"},
+	{"reencrypt-all", "Revalidate every secrets file in the directory"},
+	{"merge-hosts", "Add the hosts from another hosts file"},
+	{"rename-host", "Change a host's name in the hosts file"},
+	{"list-hosts", "Show authorized hosts and their descriptions"},
+	{"generate-key", "Create this host's key without authorizing it"},
+	{"rotate-key", "Replace this host's key and reencrypt"},
+	{"rekey", "Drop this host's superseded keys and reencrypt"},
+	{"check-host-access", "Check whether this host can decrypt"},
+	{"whoami", "Show this host's key and whether it can decrypt"},
+	{"fingerprint", "Print this host's key fingerprint"},
+	{"sync", "Pull, run a command, then commit and push its changes"},
+	{"completion", "Print a shell completion script"},
+	{"version", "Print version information"},
+}
+
+// Lists key names for get and unset without ever prompting: check-host-access
+// fails fast (stdin closed) on hosts that can't decrypt. %[1]s is the global
+// flags given before the command, so keys come from the same secrets file.
+const completeKeysCommand = "secrets %[1]s check-host-access </dev/null >/dev/null 2>&1 && secrets %[1]s list --keys 2>/dev/null"
+
+var (
+	activateShells   = []string{"fish", "bash", "zsh", "sh", "powershell", "pwsh", "github", "docker"}
+	completionShells = []string{"bash", "zsh", "fish"}
+)
+
+// Global flags may come before the command (secrets --secrets-path DIR get
+// KEY), so each script skips them, and the values of those that take one,
+// to find the command. %[1]s is the flags that take a value.
+const bashCompletion = `# bash completion for secrets
+_secrets() {
+    local cur i word
+    local -a globals
+    cur="${COMP_WORDS[COMP_CWORD]}"
+
+    # bash splits --flag=value into three words
+    i=1
+    while [ "$i" -lt "$COMP_CWORD" ]; do
+        word="${COMP_WORDS[i]}"
+        if [ "${COMP_WORDS[i+1]}" = "=" ]; then
+            globals+=("$word=${COMP_WORDS[i+2]}")
+            i=$((i + 3))
+            continue
+        fi
+        case "$word" in
+            %[1]s)
+                globals+=("$word" "${COMP_WORDS[i+1]}")
+                i=$((i + 2))
+                ;;
+            -*)
+                globals+=("$word")
+                i=$((i + 1))
+                ;;
+            *)
+                break
+                ;;
+        esac
+    done
+
+    # Past the end means the cursor is on a flag's value
+    if [ "$i" -gt "$COMP_CWORD" ]; then
+        return
+    fi
+    if [ "$i" -eq "$COMP_CWORD" ]; then
+        COMPREPLY=($(compgen -W "%[2]s" -- "$cur"))
+        return
+    fi
+
+    case "${COMP_WORDS[i]}" in
+        activate)
+            [ "$COMP_CWORD" -eq $((i + 1)) ] && COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+            ;;
+        completion)
+            [ "$COMP_CWORD" -eq $((i + 1)) ] && COMPREPLY=($(compgen -W "%[4]s" -- "$cur"))
+            ;;
+        get|unset)
+            COMPREPLY=($(compgen -W "$(%[5]s)" -- "$cur"))
+            ;;
+    esac
+}
+complete -o default -F _secrets secrets
+`
+
+const zshCompletion = `#compdef secrets
+
+_secrets() {
+    local -a commands globals
+    commands=(
+%[2]s
+    )
+
+    local i=2
+    while (( i < CURRENT )); do
+        case $words[i] in
+            (%[1]s)
+                globals+=($words[i] $words[i+1])
+                (( i += 2 ))
+                ;;
+            (-*)
+                globals+=($words[i])
+                (( i++ ))
+                ;;
+            (*)
+                break
+                ;;
+        esac
+    done
+
+    # Past the end means the cursor is on a flag's value
+    if (( i > CURRENT )); then
+        _files
+        return
+    fi
+    if (( i == CURRENT )); then
+        _describe 'command' commands
+        return
+    fi
+
+    case $words[i] in
+        activate)
+            (( CURRENT == i + 1 )) && _values 'shell' %[3]s
+            ;;
+        completion)
+            (( CURRENT == i + 1 )) && _values 'shell' %[4]s
+            ;;
+        import|export)
+            _files
+            ;;
+        get|unset)
+            local -a keys
+            keys=(${(f)"$(%[5]s)"})
+            _values 'key' $keys
+            ;;
+    esac
+}
+
+compdef _secrets secrets
+`
+
+const fishCompletion = `# fish completion for secrets
+
+# Print the global flags before the command, with their values; fails while
+# the cursor is on a flag's value
+function __secrets_globals
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    while set -q tokens[1]
+        if contains -- $tokens[1] %[1]s
+            set -q tokens[2]; or return 1
+            printf '%%s\n' $tokens[1..2]
+            set -e tokens[1..2]
+        else if string match -q -- '-*' $tokens[1]
+            printf '%%s\n' $tokens[1]
+            set -e tokens[1]
+        else
+            break
+        end
+    end
+end
+
+# Whether the command itself is being completed
+function __secrets_needs_command
+    set -l globals (__secrets_globals); or return 1
+    test (count $globals) -eq (math (count (commandline -opc)) - 1)
+end
+
+complete -c secrets -f
+%[2]s
+complete -c secrets -n '__fish_seen_subcommand_from activate' -a '%[3]s'
+complete -c secrets -n '__fish_seen_subcommand_from completion' -a '%[4]s'
+complete -c secrets -n '__fish_seen_subcommand_from import export' -F
+complete -c secrets -n '__fish_seen_subcommand_from get unset' -a '(%[5]s)'
+`
+
+// Global flags that take a value, as both -name and --name
+func globalValueFlags() []string {
+	var names []string
+	newFlagSet("completion").VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			return
+		}
+		names = append(names, "--"+f.Name, "-"+f.Name)
+	})
+	return names
+}
+
+func cmdCompletion(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: secrets completion <shell>\nSupported shells: " + strings.Join(completionShells, ", "))
+	}
+
+	var names []string
+	for _, c := range completionCommands {
+		names = append(names, c.name)
+	}
+
+	valueFlags := globalValueFlags()
+	activate := strings.Join(activateShells, " ")
+	completion := strings.Join(completionShells, " ")
+	switch args[0] {
+	case "bash":
+		keys := fmt.Sprintf(completeKeysCommand, `"${globals[@]}"`)
+		fmt.Printf(bashCompletion, strings.Join(valueFlags, "|"), strings.Join(names, " "), activate, completion, keys)
+	case "zsh":
+		// _describe splits name from description at the first unescaped colon
+		var described []string
+		for _, c := range completionCommands {
+			described = append(described, "        "+quotePosix(strings.ReplaceAll(c.name, ":", `\:`)+":"+c.description))
+		}
+		keys := fmt.Sprintf(completeKeysCommand, `"${globals[@]}"`)
+		fmt.Printf(zshCompletion, strings.Join(valueFlags, "|"), strings.Join(described, "\n"), activate, completion, keys)
+	case "fish":
+		var lines []string
+		for _, c := range completionCommands {
+			lines = append(lines, fmt.Sprintf("complete -c secrets -n __secrets_needs_command -a %s -d %s", quoteFish(c.name), quoteFish(c.description)))
+		}
+		keys := fmt.Sprintf(completeKeysCommand, "(__secrets_globals)")
+		fmt.Printf(fishCompletion, strings.Join(valueFlags, " "), strings.Join(lines, "\n"), activate, completion, keys)
+	default:
+		return fmt.Errorf("Unsupported shell: %s. Supported shells: %s", args[0], strings.Join(completionShells, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Descriptions with apostrophes are quoted for each shell, and every script
+// parses in its shell where that shell is installed
+func TestCompletionQuoting(t *testing.T) {
+	tests := []struct {
+		shell, want string
+	}{
+		{"bash", ""},
+		{"zsh", `        'rename-host:Change a host'\''s name in the hosts file'`},
+		{"fish", `complete -c secrets -n __secrets_needs_command -a 'rename-host' -d 'Change a host\'s name in the hosts file'`},
+	}
+	for _, tt := range tests {
+		out, err := captureStdout(t, func() error { return cmdCompletion([]string{tt.shell}) })
+		if err != nil {
+			t.Fatalf("completion %s: %v", tt.shell, err)
+		}
+		if tt.want != "" && !strings.Contains(out, tt.want+"\n") {
+			t.Errorf("completion %s doesn't contain\n%s\nin\n%s", tt.shell, tt.want, out)
+		}
+
+		if _, err := exec.LookPath(tt.shell); err != nil {
+			t.Logf("%s isn't installed, not parsing its script", tt.shell)
+			continue
+		}
+		path := filepath.Join(t.TempDir(), "completion")
+		if err := os.WriteFile(path, []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := exec.Command(tt.shell, "-n", path).CombinedOutput(); err != nil {
+			t.Errorf("%s -n on its completion script: %v\n%s", tt.shell, err, msg)
+		}
+	}
+}
+
+// Global flags before the command are skipped to find it, and passed on
+// when listing keys
+func TestBashCompletionGlobalFlags(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash isn't installed")
+	}
+	script, err := captureStdout(t, func() error { return cmdCompletion([]string{"bash"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for secrets, listing keys only for the directory it's given
+	fake := `secrets() {
+    case "$*" in
+        "--secrets-path /tmp/other "*|"--secrets-path=/tmp/other "*) ;;
+        *) return 1 ;;
+    esac
+    case "$*" in
+        *" list --keys") printf 'FOO\nFOOBAR\nBAZ\n' ;;
+    esac
+}
+`
+	tests := []struct {
+		words string
+		want  string
+	}{
+		{"secrets get FO", ""},
+		{"secrets --secrets-path /tmp/other get FO", "FOO FOOBAR"},
+		{"secrets --secrets-path=/tmp/other get FO", "FOO FOOBAR"},
+		{"secrets --secrets-path /tmp/other --yes unset BA", "BAZ"},
+		{"secrets --secrets-path /tmp/other rename-h", "rename-host"},
+		{"secrets --verbose activate fi", "fish"},
+		{"secrets --key ", ""},
+	}
+	for _, tt := range tests {
+		words := strings.Fields(tt.words)
+		if strings.HasSuffix(tt.words, " ") {
+			words = append(words, "")
+		}
+		// bash splits --flag=value at the = for completion
+		var split []string
+		for _, w := range words {
+			if name, value, ok := strings.Cut(w, "="); ok && strings.HasPrefix(w, "-") {
+				split = append(split, name, "=", value)
+				continue
+			}
+			split = append(split, w)
+		}
+		run := script + fake + "COMP_WORDS=(" + strings.Join(quoteAll(split), " ") + ")\n" +
+			"COMP_CWORD=$((${#COMP_WORDS[@]} - 1))\n" +
+			"_secrets\n" +
+			`echo "${COMPREPLY[*]}"` + "\n"
+		out, err := exec.Command("bash", "-c", run).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tt.words, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("completing %q offered %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
+
+func quoteAll(words []string) []string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = quotePosix(w)
+	}
+	return quoted
+}
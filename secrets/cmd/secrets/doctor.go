@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/shardul/secrets"
+	"golang.org/x/crypto/ssh"
+)
+
+// Mode for secrets directories this tool creates, before the umask; set
+// with --dir-mode
+var dirMode os.FileMode = 0700
+
+// Parse --dir-mode as an octal mode the owner can still use
+func setDirMode(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid mode %q, expected octal like 0700", s)
+	}
+	if mode&0700 != 0700 {
+		return fmt.Errorf("mode %q must give the owner read, write and search (0700)", s)
+	}
+	dirMode = os.FileMode(mode)
+	return nil
+}
+
+// Create the directory holding the hosts file if it doesn't exist
+func makeSecretsDir() error {
+	if err := os.MkdirAll(filepath.Dir(secretsHosts), dirMode); err != nil {
+		return errors.New("Failed to create secrets directory")
+	}
+	return nil
+}
+
+// Describe what's too loose about the permissions of a private key or
+// identity file (readable or writable by anyone but its owner), or ""
+func loosePrivateKeyMode(mode os.FileMode) string {
+	if mode.Perm()&0077 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("is accessible by group or others (%04o)", mode.Perm())
+}
+
+// Describe what's too loose about the permissions of the secrets
+// directory, or "". Others being able to write it means they can swap the
+// hosts file; reading it only exposes encrypted files and public keys.
+func looseDirMode(mode os.FileMode) string {
+	if mode.Perm()&0022 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("is writable by group or others (%04o)", mode.Perm())
+}
+
+// Paths already warned about, so a key loaded twice warns once
+var warnedPermissions = make(map[string]bool)
+
+// Warn on stderr if the private key or identity file at path can be read by
+// anyone but its owner. ssh refuses such keys; this only warns.
+func warnLoosePermissions(path string) {
+	info, err := os.Stat(path)
+	if err != nil || warnedPermissions[path] {
+		return
+	}
+	if problem := loosePrivateKeyMode(info.Mode()); problem != "" {
+		warnedPermissions[path] = true
+		fmt.Fprintf(os.Stderr, "Warning: %s %s; run 'chmod 600 %s'\n", path, problem, path)
+	}
+}
+
+// How much a doctor check's problem matters
+const (
+	checkOK   = iota
+	checkWarn // Worth fixing, but the tool still works
+	checkFail // The tool can't work, or its secrets aren't safe
+)
+
+// Check everything new setups get wrong (SECRETS_PATH, keys and their
+// permissions, the hosts file, access, the editor), printing one line per
+// check with a fix for each problem. Fails if any critical check does.
+func cmdDoctor(args []string) error {
+	if args = parseArgs(newFlagSet("doctor"), args); len(args) != 0 {
+		return errors.New("Usage: secrets doctor")
+	}
+
+	failed := 0
+	var report doctorReport = func(level int, what, problem, fix string) {
+		switch level {
+		case checkOK:
+			fmt.Printf("%s %s\n", okText("[ok]  "), what)
+			return
+		case checkWarn:
+			fmt.Printf("%s %s %s\n", noteText("[warn]"), what, problem)
+		default:
+			failed++
+			fmt.Printf("%s %s %s\n", badText("[fail]"), what, problem)
+		}
+		if fix != "" {
+			fmt.Printf("       Fix: %s\n", fix)
+		}
+	}
+
+	// Everything but the editor lives in or is found through SECRETS_PATH
+	if err := setupPaths(); err != nil {
+		report(checkFail, "Secrets directory", "is not configured: "+err.Error(), "export SECRETS_PATH=<directory for secrets.age and secrets.hosts>")
+	} else {
+		doctorSecretsDir(report)
+		doctorIdentity(report)
+		doctorHosts(report)
+		doctorAccess(report)
+	}
+
+	if path, err := findEditor(""); err != nil {
+		report(checkWarn, "Editor", "was not found", "set $EDITOR to an editor on your $PATH, or install nano (only 'secrets edit' needs one)")
+	} else {
+		report(checkOK, "Editor "+path, "", "")
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d critical check(s) failed\n", failed)
+		return exitCode(1)
+	}
+	return nil
+}
+
+// Reports one doctor check at the given level
+type doctorReport func(level int, what, problem, fix string)
+
+// The secrets directory exists, can be written and can't be by others
+func doctorSecretsDir(report doctorReport) {
+	what := "Secrets directory " + secretsPath
+	info, err := os.Stat(secretsPath)
+	if os.IsNotExist(err) {
+		report(checkFail, what, "does not exist", "run 'secrets add-this-host' to create it, or point SECRETS_PATH at your checkout")
+		return
+	}
+	if err != nil {
+		report(checkFail, what, "can't be read: "+err.Error(), "check the path and its permissions")
+		return
+	}
+	if !info.IsDir() {
+		report(checkFail, what, "is not a directory", "point SECRETS_PATH at a directory")
+		return
+	}
+
+	probe, err := os.CreateTemp(secretsPath, ".doctor")
+	if err != nil {
+		report(checkFail, what, "is not writable", "chown or chmod u+w "+secretsPath)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	if problem := looseDirMode(info.Mode()); problem != "" {
+		report(checkFail, what, problem, "chmod go-w "+secretsPath)
+		return
+	}
+	report(checkOK, what, "", "")
+}
+
+// Some identity can decrypt (an SSH key, ssh-agent keys or the age identity
+// file), each one present parses, and private keys are kept private
+func doctorIdentity(report doctorReport) {
+	// Loose permissions are reported below, not warned about on stderr too
+	warnedPermissions[secretsID] = true
+	warnedPermissions[secretsAgeID] = true
+
+	found := false
+
+	if info, err := os.Stat(secretsID); err == nil {
+		found = true
+		what := "SSH key " + secretsID
+		if _, err := loadSSHIdentity(); err != nil {
+			report(checkFail, what, "can't be used: "+err.Error(), "replace it with 'secrets generate-key --force ed25519'")
+		} else if problem := loosePrivateKeyMode(info.Mode()); problem != "" {
+			report(checkFail, what, problem, "chmod 600 "+secretsID)
+		} else {
+			report(checkOK, what, "", "")
+		}
+
+		pubPath := secretsID + ".pub"
+		if pubKey, err := readFile(pubPath); err != nil {
+			report(checkFail, "Public key "+pubPath, "can't be read: "+err.Error(), fmt.Sprintf("ssh-keygen -y -f %s > %s", secretsID, pubPath))
+		} else if _, _, _, _, err := ssh.ParseAuthorizedKey(pubKey); err != nil {
+			report(checkFail, "Public key "+pubPath, "is not a public key: "+err.Error(), fmt.Sprintf("ssh-keygen -y -f %s > %s", secretsID, pubPath))
+		} else {
+			report(checkOK, "Public key "+pubPath, "", "")
+		}
+	}
+
+	if agentIDs, err := loadAgentIdentities(); err == nil && len(agentIDs) > 0 {
+		found = true
+		report(checkOK, fmt.Sprintf("ssh-agent (%d usable key(s))", len(agentIDs)), "", "")
+	}
+
+	if info, err := os.Stat(secretsAgeID); err == nil {
+		found = true
+		what := "Age identity " + secretsAgeID
+		if _, err := loadAgeIdentities(secretsAgeID); err != nil {
+			report(checkFail, what, "can't be used: "+err.Error(), "check the file holds AGE-SECRET-KEY-... or AGE-PLUGIN-... lines")
+		} else if problem := loosePrivateKeyMode(info.Mode()); problem != "" {
+			report(checkFail, what, problem, "chmod 600 "+secretsAgeID)
+		} else {
+			report(checkOK, what, "", "")
+		}
+	} else if os.Getenv("AGE_IDENTITY") != "" {
+		report(checkFail, "Age identity "+secretsAgeID, "does not exist", "fix or unset $AGE_IDENTITY")
+	}
+
+	if !found {
+		report(checkFail, "Identity", fmt.Sprintf("not found (tried %s, ssh-agent and %s)", secretsID, secretsAgeID), "run 'secrets generate-key ed25519', or set SECRETS_ID to your key")
+	}
+}
+
+// The hosts file can be read and lists hosts to encrypt to
+func doctorHosts(report doctorReport) {
+	what := "Hosts file " + secretsHosts
+	if !hostsExist(secretsHosts) {
+		report(checkWarn, what, "does not exist yet", "run 'secrets add-this-host'")
+		return
+	}
+	hostsContent, err := readHosts(secretsHosts)
+	if err != nil {
+		report(checkFail, what, "can't be read: "+err.Error(), "check its permissions")
+		return
+	}
+	recipients, skipped := secrets.ParseHosts(hostsContent)
+	switch {
+	case len(recipients) == 0:
+		report(checkWarn, what, "lists no usable hosts", "run 'secrets add-this-host'")
+	case len(skipped) > 0:
+		report(checkWarn, what, fmt.Sprintf("has %d line(s) that can't be used", len(skipped)), "run 'secrets list-hosts' to see them")
+	default:
+		report(checkOK, fmt.Sprintf("%s (%d host(s))", what, len(recipients)), "", "")
+	}
+}
+
+// This host can decrypt the secrets file, judged as check-host-access does
+func doctorAccess(report doctorReport) {
+	what := "Access to " + secretsFile
+	status, err := hostAccessStatus()
+	switch {
+	case err != nil:
+		report(checkFail, what, err.Error(), "fix the identity problems above")
+	case status == accessOK:
+		report(checkOK, what, "", "")
+	case status == accessNoSecrets:
+		report(checkWarn, what, accessDescriptions[status], "run 'secrets edit' to create it")
+	default:
+		report(checkFail, what, accessDescriptions[status], "run 'secrets check-host-access' for the steps")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Print the secrets as a dotenv file for direnv, which can read one from
+// stdin given /dev/stdin as its path. In .envrc:
+//
+//	eval "$(secrets dump-env | direnv dotenv bash /dev/stdin)"
+//	watch_file "$SECRETS_PATH/secrets.age"
+//
+// Unlike activate this prints bare KEY=value pairs, and unlike export it
+// prints only the variables, without comments, sections or heredocs.
+func cmdDumpEnv(args []string) error {
+	fs := newFlagSet("dump-env")
+	only := fs.String("only", "", "Comma-separated keys to include")
+	except := fs.String("except", "", "Comma-separated keys to exclude")
+	section := fs.String("section", "", "Only include keys under this [section]")
+	if args = parseArgs(fs, args); len(args) != 0 {
+		return errors.New("Usage: secrets dump-env [--only KEYS] [--except KEYS] [--section NAME]")
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	vars, err := filterSection(parseEnv(content), *section)
+	if err != nil {
+		return err
+	}
+	vars, err = filterEnv(vars, *only, *except)
+	if err != nil {
+		return err
+	}
+	ignored, err := loadActivateIgnore(secretsPath)
+	if err != nil {
+		return err
+	}
+	vars = filterIgnored(vars, ignored, *only)
+
+	// Build everything first so a bad key doesn't leave half a file
+	var out bytes.Buffer
+	defer func() { zero(out.Bytes()) }()
+	for _, v := range vars {
+		if !validKey.MatchString(v.key) {
+			return fmt.Errorf("%s is not a valid variable name, which a dotenv file can't hold", v.key)
+		}
+		fmt.Fprintf(&out, "%s=%s\n", v.key, quoteDotenv(v.value))
+	}
+	os.Stdout.Write(out.Bytes())
+	return nil
+}
+
+// Quote a value for direnv's dotenv parser. Single quotes keep everything
+// literal but can't hold a quote or a line break; otherwise double quotes,
+// where \n is a newline and \ escapes ", $ and itself.
+func quoteDotenv(value string) string {
+	if !strings.ContainsAny(value, "'\r\n") {
+		return "'" + value + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '\\', '"', '$':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Run the editor on path, attached to this terminal. Any failure is
+// reported the same way, except being killed by --timeout.
+func runEditor(editorPath, path string) error {
+	ctx, cancel := commandContext()
+	defer cancel()
+	cmd := exec.CommandContext(ctx, editorPath, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := timeoutError(ctx, "the editor", cmd.Run()); err != nil {
+		if errors.Is(err, errTimedOut) {
+			return err
+		}
+		return errors.New("editor exited with error")
+	}
+	return nil
+}
+
+// Edit content in a private temp file (on tmpfs where available) and return
+// what the editor saved. The file only exists while the editor runs.
+func editViaTempFile(editorPath string, content []byte) ([]byte, error) {
+	tmpFile, err := createSecureTemp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	created, err := tmpFile.Stat()
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat temp file: %w", err)
+	}
+
+	if err := writeFile(tmpFile.Name(), content); err != nil {
+		return nil, fmt.Errorf("failed to write decrypted content: %w", err)
+	}
+	if err := runEditor(editorPath, tmpFile.Name()); err != nil {
+		return nil, err
+	}
+	if err := checkEditedFile(tmpFile.Name(), created); err != nil {
+		return nil, err
+	}
+	return readFile(tmpFile.Name())
+}
+
+// Editors that save by writing a new file and renaming it over the old one
+// can leave the plaintext with their own default mode. Put 0600 back before
+// reading it, and warn if it was looser in the meantime.
+func checkEditedFile(path string, created os.FileInfo) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat edited file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("editor left %s as something other than a regular file", path)
+	}
+	if !os.SameFile(info, created) {
+		debugf("editor replaced %s with a new file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the editor saved the plaintext with mode %04o, readable by other users until now\n", perm)
+	}
+	if info.Mode().Perm() != 0600 {
+		if err := os.Chmod(path, 0600); err != nil {
+			return fmt.Errorf("failed to restrict edited file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func editViaFIFO(editorPath string, content []byte) ([]byte, error) {
+	return nil, fmt.Errorf("--fifo is only supported on Unix")
+}
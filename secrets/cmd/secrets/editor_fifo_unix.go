@@ -0,0 +1,90 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Edit content through a named pipe so the plaintext never lands in a file.
+// The editor must read the pipe once and then save by writing back into it.
+// Editors that reopen the file to read it again will hang, and ones that
+// save by renaming a new file over the original put the plaintext back on
+// disk (it's read and removed, with a warning).
+func editViaFIFO(editorPath string, content []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp(secureTempDir(), "secrets")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets.env")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, fmt.Errorf("failed to create named pipe: %w", err)
+	}
+	debugf("plaintext named pipe %s", path)
+
+	// Feed the editor's read, then collect its save. Each open blocks until
+	// the editor opens the other end, and each close signals EOF.
+	var saved bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			done <- err
+			return
+		}
+		w.Write(content)
+		w.Close()
+
+		r, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = io.Copy(&saved, r)
+		r.Close()
+		done <- err
+	}()
+
+	if err := runEditor(editorPath, path); err != nil {
+		return nil, err
+	}
+
+	// If the editor skipped a step, stand in for it so the blocked open
+	// returns and the copy finishes
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return nil, fmt.Errorf("failed to use named pipe: %w", err)
+			}
+			// An empty save can't be valid secrets, so it means no save
+			if saved.Len() == 0 {
+				return content, nil
+			}
+			return saved.Bytes(), nil
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, fmt.Errorf("named pipe disappeared: %w", err)
+		}
+		if info.Mode().IsRegular() {
+			fmt.Fprintln(os.Stderr, "Warning: the editor replaced the named pipe with a file; it was read and removed")
+			return readFile(path)
+		}
+		for _, flag := range []int{os.O_RDONLY, os.O_WRONLY} {
+			if f, err := os.OpenFile(path, flag|syscall.O_NONBLOCK, 0); err == nil {
+				f.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shardul/secrets"
+)
+
+// Key names must be usable as shell variables unless --allow-any-key is set
+var validKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A single KEY=value pair from the decrypted secrets
+type envVar struct {
+	key     string
+	value   string
+	section string // Name of the enclosing [section], empty before any header
+}
+
+// Convert CRLF line endings (from Windows editors or pasted content) to LF
+// so a stray carriage return never ends up in a value or the stored file
+func normalizeNewlines(content []byte) []byte {
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
+
+// Parse KEY=value lines, skipping blanks and comments and noting which
+// section each key is in
+func parseEnv(content []byte) []envVar {
+	var vars []envVar
+	section := ""
+	for _, line := range secrets.SplitEnvLines(content) {
+		if name, ok := secrets.SectionHeader(line); ok {
+			section = name
+			continue
+		}
+		if key, value, ok := secrets.SplitEnvLine(line); ok {
+			vars = append(vars, envVar{key: key, value: value, section: section})
+		}
+	}
+	return vars
+}
+
+// Keep only the keys under the named section; an empty name keeps them all
+func filterSection(vars []envVar, section string) ([]envVar, error) {
+	if section == "" {
+		return vars, nil
+	}
+
+	var filtered []envVar
+	for _, v := range vars {
+		if v.section == section {
+			filtered = append(filtered, v)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no keys in section %q", section)
+	}
+	return filtered, nil
+}
+
+// Split a comma-separated list of key names, ignoring empty entries
+func splitKeyList(list string) []string {
+	var keys []string
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Keep only the keys named in only, then drop those named in except (both
+// comma-separated, empty meaning no filter). Every key named in only must
+// exist so a typo doesn't silently export nothing.
+func filterEnv(vars []envVar, only, except string) ([]envVar, error) {
+	onlyKeys := splitKeyList(only)
+	if len(onlyKeys) > 0 {
+		defined := make(map[string]bool)
+		for _, v := range vars {
+			defined[v.key] = true
+		}
+		var missing []string
+		for _, key := range onlyKeys {
+			if !defined[key] {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("unknown key(s) in --only: %s", strings.Join(missing, ", "))
+		}
+	}
+
+	keep := make(map[string]bool)
+	for _, key := range onlyKeys {
+		keep[key] = true
+	}
+	drop := make(map[string]bool)
+	for _, key := range splitKeyList(except) {
+		drop[key] = true
+	}
+
+	var filtered []envVar
+	for _, v := range vars {
+		if (len(keep) == 0 || keep[v.key]) && !drop[v.key] {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered, nil
+}
+
+// Optional file in the secrets directory listing key names or globs, one
+// per line, that activate leaves out: bookkeeping keys like _LAST_ROTATED
+// kept alongside the secrets but not wanted in every shell. list and the
+// other commands still show them.
+const activateIgnoreName = ".activateignore"
+
+// Read the patterns in dir's .activateignore, skipping blank lines and #
+// comments. A missing file is not an error and returns nil.
+func loadActivateIgnore(dir string) ([]string, error) {
+	content, err := readFile(filepath.Join(dir, activateIgnoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s: line %d has a bad pattern %q", activateIgnoreName, i+1, line)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// Drop the keys matching any of patterns, except those named in only (a
+// comma-separated list), which were asked for explicitly
+func filterIgnored(vars []envVar, patterns []string, only string) []envVar {
+	if len(patterns) == 0 {
+		return vars
+	}
+	keep := make(map[string]bool)
+	for _, key := range splitKeyList(only) {
+		keep[key] = true
+	}
+
+	var filtered []envVar
+	for _, v := range vars {
+		ignored := false
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, v.key); ok {
+				ignored = true
+				break
+			}
+		}
+		if !ignored || keep[v.key] {
+			filtered = append(filtered, v)
+		} else {
+			debugf("%s is in %s, not activating it", v.key, activateIgnoreName)
+		}
+	}
+	return filtered
+}
+
+// Ensure all non-empty, non-comment lines are KEY=value format, KEY<<TAG
+// heredoc blocks or [section] headers and that there is at least one
+// variable. A key may appear once per section. Returns the keys in file
+// order; errors name the 1-based line at fault.
+func validateEnv(content []byte) (keys []string, err error) {
+	var qualified []string
+	keyLines := make(map[string][]int)
+	section := ""
+	lineNumber := 0
+	for _, line := range secrets.SplitEnvLines(content) {
+		// Heredoc blocks span several physical lines
+		n := lineNumber + 1
+		lineNumber += strings.Count(line, "\n") + 1
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := secrets.SectionHeader(line); ok {
+			section = name
+			continue
+		}
+		if key, tag, ok := secrets.HeredocStart(line); ok {
+			return nil, fmt.Errorf("line %d: %s<<%s is never closed by a line with just %s", n, key, tag, tag)
+		}
+		key, _, ok := secrets.SplitEnvLine(line)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: invalid file format. All lines must be KEY=value format. Invalid line: %s", n, line)
+		}
+		if !allowAnyKey && !validKey.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key name %q: keys must match %s (use --allow-any-key to override)", n, key, validKey)
+		}
+		keys = append(keys, key)
+
+		if section != "" {
+			key = "[" + section + "] " + key
+		}
+		if _, seen := keyLines[key]; !seen {
+			qualified = append(qualified, key)
+		}
+		keyLines[key] = append(keyLines[key], n)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("file must contain at least one KEY=value line")
+	}
+
+	var duplicates []string
+	for _, key := range qualified {
+		if len(keyLines[key]) > 1 {
+			lineNumbers := make([]string, len(keyLines[key]))
+			for i, n := range keyLines[key] {
+				lineNumbers[i] = strconv.Itoa(n)
+			}
+			duplicates = append(duplicates, fmt.Sprintf("%s (lines %s)", key, strings.Join(lineNumbers, ", ")))
+		}
+	}
+	if len(duplicates) > 0 {
+		return nil, fmt.Errorf("duplicate keys: %s (use --dedup to keep the last of each)", strings.Join(duplicates, "; "))
+	}
+	return keys, nil
+}
+
+// Drop all but the last definition of each key within its section,
+// leaving comments and the position of the surviving lines untouched
+func dedupEnv(content []byte) []byte {
+	lines := secrets.SplitEnvLines(content)
+	sectionKeys := make([]string, len(lines))
+	last := make(map[string]int)
+	section := ""
+	for i, line := range lines {
+		if name, ok := secrets.SectionHeader(line); ok {
+			section = name
+		} else if key, _, ok := secrets.SplitEnvLine(line); ok {
+			sectionKeys[i] = section + "\x00" + key
+			last[sectionKeys[i]] = i
+		}
+	}
+
+	var kept []string
+	for i, line := range lines {
+		if sectionKeys[i] != "" && last[sectionKeys[i]] != i {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
+
+// A line of the secrets file. Comments, blank lines and anything else that
+// isn't KEY=value are kept verbatim in raw so commands that rewrite the file
+// only touch the keys they target.
+type envLine struct {
+	raw       string
+	key       string
+	value     string
+	isComment bool
+}
+
+// Parse the secrets file into lines that can be modified and written back
+// with formatEnvLines without losing comments or ordering
+func parseEnvLines(content []byte) []envLine {
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return nil
+	}
+
+	var lines []envLine
+	for _, raw := range secrets.SplitEnvLines([]byte(text)) {
+		key, value, ok := secrets.SplitEnvLine(raw)
+		lines = append(lines, envLine{raw: raw, key: key, value: value, isComment: !ok})
+	}
+	return lines
+}
+
+// Serialize lines back into file content. Untouched lines keep their raw
+// text; changed ones are written as KEY=value.
+func formatEnvLines(lines []envLine) []byte {
+	var b strings.Builder
+	for _, line := range lines {
+		if line.raw != "" || line.isComment {
+			b.WriteString(line.raw)
+		} else {
+			b.WriteString(secrets.FormatEnvLine(line.key, line.value))
+		}
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// Set key to value in place, or append it if it isn't defined yet. Reports
+// whether the key already existed.
+func setEnvValue(lines []envLine, key, value string) ([]envLine, bool) {
+	found := false
+	for i := range lines {
+		if !lines[i].isComment && lines[i].key == key {
+			if lines[i].value != value {
+				lines[i] = envLine{key: key, value: value}
+			}
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, envLine{key: key, value: value})
+	}
+	return lines, found
+}
+
+// Remove every definition of key. Reports whether it was defined.
+func unsetEnvKey(lines []envLine, key string) ([]envLine, bool) {
+	var kept []envLine
+	found := false
+	for _, line := range lines {
+		if !line.isComment && line.key == key {
+			found = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept, found
+}
+
+// Merge imported KEY=value lines onto existing content. Existing keys are
+// overwritten in place and new keys are appended in import order.
+func mergeEnv(current, imported []byte) (merged []byte, added, updated int) {
+	lines := parseEnvLines(current)
+	for _, v := range parseEnv(imported) {
+		var existed bool
+		lines, existed = setEnvValue(lines, v.key, v.value)
+		if existed {
+			updated++
+		} else {
+			added++
+		}
+	}
+	return formatEnvLines(lines), added, updated
+}
+
+// Keys in imported that current already defines with a different value
+func envConflicts(current, imported []byte) []string {
+	existing := make(map[string]string)
+	for _, v := range parseEnv(current) {
+		existing[v.key] = v.value
+	}
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, v := range parseEnv(imported) {
+		if value, ok := existing[v.key]; ok && value != v.value && !seen[v.key] {
+			conflicts = append(conflicts, v.key)
+			seen[v.key] = true
+		}
+	}
+	return conflicts
+}
+
+// Append imported KEY=value lines onto existing content like mergeEnv, but
+// with keep set a key that already exists keeps its value. Keys whose value
+// doesn't change are counted as skipped either way.
+func appendEnv(current, imported []byte, keep bool) (merged []byte, added, overwritten, skipped int) {
+	existing := make(map[string]string)
+	for _, v := range parseEnv(current) {
+		existing[v.key] = v.value
+	}
+	lines := parseEnvLines(current)
+	for _, v := range parseEnv(imported) {
+		if value, ok := existing[v.key]; ok && (keep || value == v.value) {
+			skipped++
+			continue
+		}
+		var existed bool
+		lines, existed = setEnvValue(lines, v.key, v.value)
+		existing[v.key] = v.value
+		if existed {
+			overwritten++
+		} else {
+			added++
+		}
+	}
+	return formatEnvLines(lines), added, overwritten, skipped
+}
+
+// Hide a secret value, revealing the first and last character of long
+// values (g****n) so you can still tell which secret is set. Intentionally
+// empty values (KEY=) have nothing to hide and stay empty. Multiline values
+// are masked whole, as their ends are mostly PEM boilerplate or a newline.
+func maskValue(value string) string {
+	runes := []rune(value)
+	if len(runes) == 0 {
+		return ""
+	}
+	if len(runes) < 8 || strings.ContainsAny(value, "\r\n") {
+		return "****"
+	}
+	return string(runes[0]) + "****" + string(runes[len(runes)-1])
+}
+
+// Mask the value of every KEY=value line, keeping comments and layout. A
+// heredoc block shrinks to a single masked line.
+func maskEnv(content []byte) []byte {
+	lines := secrets.SplitEnvLines(content)
+	for i, line := range lines {
+		if key, value, ok := secrets.SplitEnvLine(line); ok {
+			lines[i] = key + "=" + maskValue(value)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Describe keys added (+), removed (-) and changed (~) between two versions
+// of the secrets. Values are masked unless showValues is set.
+func diffEnv(before, after []byte, showValues bool) []string {
+	show := func(value string) string {
+		if showValues && !mask {
+			return value
+		}
+		return maskValue(value)
+	}
+
+	old := make(map[string]string)
+	for _, v := range parseEnv(before) {
+		old[v.key] = v.value
+	}
+	current := make(map[string]string)
+	for _, v := range parseEnv(after) {
+		current[v.key] = v.value
+	}
+
+	var changes []string
+	seen := make(map[string]bool)
+	for _, v := range parseEnv(after) {
+		if seen[v.key] {
+			continue
+		}
+		seen[v.key] = true
+
+		oldValue, existed := old[v.key]
+		newValue := current[v.key]
+		switch {
+		case !existed:
+			changes = append(changes, fmt.Sprintf("+ %s=%s", v.key, show(newValue)))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("~ %s=%s -> %s", v.key, show(oldValue), show(newValue)))
+		}
+	}
+	for _, v := range parseEnv(before) {
+		if _, exists := current[v.key]; !exists && !seen[v.key] {
+			seen[v.key] = true
+			changes = append(changes, fmt.Sprintf("- %s=%s", v.key, show(v.value)))
+		}
+	}
+	return changes
+}
+
+// Single-quote a value for bash/zsh/sh. Nothing is special inside single
+// quotes, so an embedded quote closes the string, adds an escaped quote and
+// reopens it. Values are always quoted, so an empty value stays valid syntax.
+func quotePosix(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Single-quote a value for fish, where \ and ' are the only escapes
+// recognized inside single quotes
+func quoteFish(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "'", `\'`)
+	return "'" + value + "'"
+}
+
+// Single-quote a value for PowerShell, where nothing is expanded and the
+// only escape is doubling the quote. PowerShell also closes a single-quoted
+// string on the curly quotes U+2018 to U+201B, so those are doubled too.
+// Note that PowerShell treats assigning an empty string to $env:KEY as
+// removing the variable.
+func quotePowerShell(value string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range value {
+		if r == '\'' || (r >= '\u2018' && r <= '\u201b') {
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// Format a variable for the file named by $GITHUB_ENV. Multiline values use
+// the KEY<<DELIMITER heredoc syntax Actions supports, with a random
+// delimiter that can't occur in the value.
+func githubEnvLine(key, value string) (string, error) {
+	if !strings.ContainsAny(value, "\r\n") {
+		return key + "=" + value + "\n", nil
+	}
+	for {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		delimiter := "ghadelimiter_" + hex.EncodeToString(nonce)
+		if !strings.Contains(value, delimiter) {
+			return key + "<<" + delimiter + "\n" + value + "\n" + delimiter + "\n", nil
+		}
+	}
+}
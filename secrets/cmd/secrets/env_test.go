@@ -0,0 +1,286 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shardul/secrets"
+)
+
+// Values activate prints have to come back out of the shell unchanged,
+// however hostile
+func TestQuoteShell(t *testing.T) {
+	tests := []struct {
+		value string
+		posix string
+		fish  string
+	}{
+		{"a b c", `'a b c'`, `'a b c'`},
+		{"$(rm -rf /)", `'$(rm -rf /)'`, `'$(rm -rf /)'`},
+		{"it's", `'it'\''s'`, `'it\'s'`},
+		{"", `''`, `''`},
+		{`C:\path\`, `'C:\path\'`, `'C:\\path\\'`},
+		{"`whoami`", "'`whoami`'", "'`whoami`'"},
+		{"line1\nline2", "'line1\nline2'", "'line1\nline2'"},
+	}
+	for _, tt := range tests {
+		if got := quotePosix(tt.value); got != tt.posix {
+			t.Errorf("quotePosix(%q) = %s, want %s", tt.value, got, tt.posix)
+		}
+		if got := quoteFish(tt.value); got != tt.fish {
+			t.Errorf("quoteFish(%q) = %s, want %s", tt.value, got, tt.fish)
+		}
+	}
+}
+
+// Inside PowerShell single quotes only the quote and its curly forms end
+// the string; "$`\ and curly double quotes are literal
+func TestQuotePowerShell(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"a b c", `'a b c'`},
+		{"$(rm -rf /)", `'$(rm -rf /)'`},
+		{"it's", `'it''s'`},
+		{"", `''`},
+		{"`\"$env:HOME\"", "'`\"$env:HOME\"'"},
+		{"“quoted” „", "'“quoted” „'"},
+		{"‘a’ ‚b‛", "'‘‘a’’ ‚‚b‛‛'"},
+	}
+	for _, tt := range tests {
+		if got := quotePowerShell(tt.value); got != tt.want {
+			t.Errorf("quotePowerShell(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    []string
+		err     string // Substring of the error, "" for none
+	}{
+		{"empty file", "", nil, "at least one KEY=value"},
+		{"blank lines only", "\n\n  \n", nil, "at least one KEY=value"},
+		{"comments only", "# one\n  # two\n", nil, "at least one KEY=value"},
+		{"one key", "FOO=bar\n", []string{"FOO"}, ""},
+		{"comments and keys", "# db\nDB_HOST=localhost\n\nDB_PORT=5432\n", []string{"DB_HOST", "DB_PORT"}, ""},
+		{"no trailing newline", "FOO=bar", []string{"FOO"}, ""},
+		{"duplicate key", "FOO=1\nBAR=2\nFOO=3\n", nil, "duplicate keys: FOO (lines 1, 3)"},
+		{"same key in two sections", "[a]\nFOO=1\n[b]\nFOO=2\n", []string{"FOO", "FOO"}, ""},
+		{"duplicate in a section", "[a]\nFOO=1\nFOO=2\n", nil, "[a] FOO (lines 2, 3)"},
+		{"no equals sign", "FOO=1\njust some text\n", nil, "line 2: invalid file format"},
+		{"empty key", "=value\n", nil, "line 1: invalid file format"},
+		{"bad line after a comment", "# header\n\nnot a pair\n", nil, "line 3:"},
+		{"unclosed heredoc", "CERT<<EOF\nabc\n", nil, "line 1: CERT<<EOF is never closed"},
+		{"line after a heredoc", "CERT<<EOF\na\nb\nEOF\nbad\n", nil, "line 5:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := validateEnv([]byte(tt.content))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("validateEnv error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateEnv: %v", err)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("validateEnv keys = %q, want %q", keys, tt.keys)
+			}
+		})
+	}
+}
+
+// KEY= stores an intentionally empty value, which has to survive
+// validation, encryption and activate in every shell
+func TestEmptyValues(t *testing.T) {
+	content := "OPTIONAL_FLAG=\nQUOTED=''\nDOUBLE=\"\"\n"
+	if _, err := validateEnv([]byte(content)); err != nil {
+		t.Fatalf("validateEnv: %v", err)
+	}
+
+	h := newTestHost(t)
+	h.writeHosts(t, h.pubKey)
+	if err := encryptSecrets([]byte(content)); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+
+	tests := []struct {
+		shell, want string
+	}{
+		{"bash", "export OPTIONAL_FLAG=''\nexport QUOTED=''\nexport DOUBLE=''\n"},
+		{"fish", "set -gx OPTIONAL_FLAG ''\nset -gx QUOTED ''\nset -gx DOUBLE ''\n"},
+		{"pwsh", "$env:OPTIONAL_FLAG = ''\n$env:QUOTED = ''\n$env:DOUBLE = ''\n"},
+		{"docker", "OPTIONAL_FLAG=\nQUOTED=\nDOUBLE=\n"},
+	}
+	for _, tt := range tests {
+		h.use(t, h.key)
+		out, err := captureStdout(t, func() error { return cmdActivate([]string{tt.shell}) })
+		if err != nil {
+			t.Fatalf("activate %s: %v", tt.shell, err)
+		}
+		if out != tt.want {
+			t.Errorf("activate %s printed\n%s\nwant\n%s", tt.shell, out, tt.want)
+		}
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"A=1\r\nB=2\r\n", "A=1\nB=2\n"},
+		{"A=1\nB=2\n", "A=1\nB=2\n"},
+		{"A=1\r\nB=2\n", "A=1\nB=2\n"},
+		{"A=1\r\nB=2", "A=1\nB=2"},
+		{"A=a\rb\n", "A=a\rb\n"}, // A lone \r isn't a line ending
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := string(normalizeNewlines([]byte(tt.in))); got != tt.want {
+			t.Errorf("normalizeNewlines(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Secrets saved with CRLF, by an editor on Windows or before edit
+// normalized them, are read without a trailing \r on any value
+func TestCRLFSecrets(t *testing.T) {
+	h := newTestHost(t)
+	h.writeHosts(t, h.pubKey)
+	if err := encryptSecrets([]byte("# comment\r\nTOKEN=abc\r\n[db]\r\nHOST=localhost\r\n")); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+
+	h.use(t, h.key)
+	content, err := decryptToBytes()
+	if err != nil {
+		t.Fatalf("decryptToBytes: %v", err)
+	}
+	if want := "# comment\nTOKEN=abc\n[db]\nHOST=localhost\n"; string(content) != want {
+		t.Errorf("decryptToBytes = %q, want %q", content, want)
+	}
+	if _, err := validateEnv(content); err != nil {
+		t.Errorf("validateEnv: %v", err)
+	}
+
+	h.use(t, h.key)
+	out, err := captureStdout(t, func() error { return cmdActivate([]string{"bash"}) })
+	if err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	if want := "export TOKEN='abc'\nexport HOST='localhost'\n"; out != want {
+		t.Errorf("activate bash printed %q, want %q", out, want)
+	}
+
+	// A file edited with CRLF is stored with LF
+	editor := testEditor(t, "TOKEN=xyz\r\n")
+	h.use(t, h.key)
+	if _, err := captureStdout(t, func() error { return cmdEdit([]string{"--editor", editor}) }); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	h.use(t, h.key)
+	identities, err := loadIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := secrets.DecryptFile(secretsFile, identities...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "TOKEN=xyz\n" {
+		t.Errorf("edit stored %q, want %q", stored, "TOKEN=xyz\n")
+	}
+}
+
+// Keys have to be shell identifiers unless --allow-any-key is given
+func TestValidKeyNames(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"FOO", true},
+		{"foo_bar", true},
+		{"_PRIVATE", true},
+		{"A1", true},
+		{"DB_PORT_2", true},
+		{"123FOO", false},
+		{"1", false},
+		{"MY KEY", false},
+		{"MY-KEY", false},
+		{"-FOO", false},
+		{"FOO.BAR", false},
+		{"FÖO", false},
+	}
+	for _, tt := range tests {
+		if got := validKey.MatchString(tt.key); got != tt.valid {
+			t.Errorf("validKey.MatchString(%q) = %v, want %v", tt.key, got, tt.valid)
+		}
+
+		_, err := validateEnv([]byte(tt.key + "=x\n"))
+		if tt.valid && err != nil {
+			t.Errorf("validateEnv(%q): %v", tt.key, err)
+		}
+		if !tt.valid && (err == nil || !strings.Contains(err.Error(), "invalid key name")) {
+			t.Errorf("validateEnv(%q) error = %v, want an invalid key name", tt.key, err)
+		}
+
+		allowAnyKey = true
+		if _, err := validateEnv([]byte(tt.key + "=x\n")); err != nil {
+			t.Errorf("validateEnv(%q) with --allow-any-key: %v", tt.key, err)
+		}
+		allowAnyKey = false
+	}
+}
+
+// Quoted values are stored unquoted and quoted again for each shell
+func TestParseEnvQuoted(t *testing.T) {
+	content := "PLAIN=bar\nDOUBLE=\"value with spaces\"\nSINGLE='it is $HOME'\nESCAPED=\"say \\\"hi\\\"\\nbye\"\nPARTIAL=a\"b\"\nOPEN=\"bar\n# QUOTED=\"comment\"\n"
+	want := []envVar{
+		{key: "PLAIN", value: "bar"},
+		{key: "DOUBLE", value: "value with spaces"},
+		{key: "SINGLE", value: "it is $HOME"},
+		{key: "ESCAPED", value: "say \"hi\"\nbye"},
+		{key: "PARTIAL", value: `a"b"`},
+		{key: "OPEN", value: `"bar`},
+	}
+	vars := parseEnv([]byte(content))
+	if !reflect.DeepEqual(vars, want) {
+		t.Fatalf("parseEnv = %+v, want %+v", vars, want)
+	}
+
+	tests := []struct {
+		shell, want string
+	}{
+		{"bash", `export PLAIN='bar'
+export DOUBLE='value with spaces'
+export SINGLE='it is $HOME'
+export ESCAPED='say "hi"
+bye'
+export PARTIAL='a"b"'
+export OPEN='"bar'
+`},
+		{"fish", `set -gx PLAIN 'bar'
+set -gx DOUBLE 'value with spaces'
+set -gx SINGLE 'it is $HOME'
+set -gx ESCAPED 'say "hi"
+bye'
+set -gx PARTIAL 'a"b"'
+set -gx OPEN '"bar'
+`},
+	}
+	for _, tt := range tests {
+		out, err := captureStdout(t, func() error { return printActivate(tt.shell, vars) })
+		if err != nil {
+			t.Fatalf("printActivate %s: %v", tt.shell, err)
+		}
+		if out != tt.want {
+			t.Errorf("printActivate %s printed\n%s\nwant\n%s", tt.shell, out, tt.want)
+		}
+	}
+}
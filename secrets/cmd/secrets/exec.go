@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// Run a command with the secrets added to its environment, like aws-vault
+// exec. Nothing is printed, so the values never pass through a shell or a
+// terminal, and the command's exit code becomes ours.
+func cmdExec(args []string) error {
+	fs := newFlagSet("exec")
+	prefix := fs.String("prefix", "", "Prepend a prefix to every variable name (e.g. PROJECT_)")
+	only := fs.String("only", "", "Comma-separated keys to include")
+	except := fs.String("except", "", "Comma-separated keys to exclude")
+	section := fs.String("section", "", "Only include keys under this [section]")
+	// Flags end at the command, so its own flags are left alone
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		return errors.New("Usage: secrets exec [--prefix PREFIX] [--only KEYS] [--except KEYS] [--section NAME] -- <command> [args...]")
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("Command not found: %s", args[0])
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	vars, err := filterSection(parseEnv(content), *section)
+	if err != nil {
+		return err
+	}
+	vars, err = filterEnv(vars, *only, *except)
+	if err != nil {
+		return err
+	}
+
+	// A prefix holding '=' would set some other variable, like PATH, so
+	// check every name before running anything, as activate does
+	if *prefix != "" {
+		for i := range vars {
+			vars[i].key = *prefix + vars[i].key
+			if !validKey.MatchString(vars[i].key) {
+				return fmt.Errorf("Prefixed name %q is not a valid variable name", vars[i].key)
+			}
+		}
+	}
+
+	// Later entries win, so the secrets override inherited variables
+	env := os.Environ()
+	for _, v := range vars {
+		env = append(env, v.key+"="+v.value)
+	}
+	debugf("running %s with %d secret(s) in its environment", path, len(vars))
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Ctrl-C reaches the command from the terminal already; just don't die
+	// before it does, or its exit code would be lost. SIGTERM is usually
+	// sent to this process alone, so pass it on.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to run %s: %w", args[0], err)
+	}
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return exitCode(128 + int(status.Signal()))
+		}
+		return exitCode(exitErr.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to run %s: %w", args[0], err)
+	}
+	return nil
+}
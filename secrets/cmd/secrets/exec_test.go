@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exec refuses a prefix that makes an invalid name, which could otherwise
+// set another variable, and runs nothing
+func TestExecPrefix(t *testing.T) {
+	h := newTestHost(t)
+	h.writeHosts(t, h.pubKey)
+	if err := encryptSecrets([]byte("FOO=bar\n")); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+	marker := filepath.Join(t.TempDir(), "ran")
+	command := []string{"--", "sh", "-c", `printf '%s' "$APP_FOO" > "` + marker + `"`}
+
+	tests := []struct {
+		prefix string
+		err    string
+	}{
+		{"PATH=/tmp:", "not a valid variable name"},
+		{"1_", "not a valid variable name"},
+		{"MY-", "not a valid variable name"},
+		{"APP_", ""},
+	}
+	for _, tt := range tests {
+		os.Remove(marker)
+		h.use(t, h.key)
+		err := cmdExec(append([]string{"--prefix", tt.prefix}, command...))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("exec --prefix %q error = %v, want %q", tt.prefix, err, tt.err)
+			}
+			if _, statErr := os.Stat(marker); !errors.Is(statErr, os.ErrNotExist) {
+				t.Errorf("exec --prefix %q ran the command", tt.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("exec --prefix %q: %v", tt.prefix, err)
+		}
+		if got, _ := os.ReadFile(marker); string(got) != "bar" {
+			t.Errorf("exec --prefix %q set APP_FOO=%q, want bar", tt.prefix, got)
+		}
+	}
+}
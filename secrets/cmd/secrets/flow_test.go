@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An editor that replaces the file it's given with $TEST_EDITOR_CONTENT
+func testEditor(t *testing.T, content string) string {
+	t.Helper()
+	t.Setenv("TEST_EDITOR_CONTENT", content)
+	path := filepath.Join(t.TempDir(), "editor")
+	script := "#!/bin/sh\nprintf '%s' \"$TEST_EDITOR_CONTENT\" > \"$1\"\n"
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A new host adds itself, writes the first secrets and activates them
+func TestAddHostEditActivate(t *testing.T) {
+	h := newTestHost(t)
+
+	out, err := captureStdout(t, func() error { return cmdAddHost(nil) })
+	if err != nil {
+		t.Fatalf("add-this-host: %v", err)
+	}
+	if !hostListedIn(secretsHosts) {
+		t.Fatal("add-this-host didn't list this host")
+	}
+	// With no secrets yet there's nothing to revalidate
+	if strings.Contains(out, "revalidate") || !strings.Contains(out, "'secrets edit' or 'secrets set'") {
+		t.Errorf("add-this-host with no secrets printed:\n%s", out)
+	}
+
+	editor := testEditor(t, "FOO=a b c\nBAR=$(rm -rf /)\nBAZ=it's\n")
+	if _, err := captureStdout(t, func() error { return cmdEdit([]string{"--editor", editor}) }); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+
+	h.use(t, h.key)
+	if _, err := captureStdout(t, func() error { return cmdCheckHostAccess(nil) }); err != nil {
+		t.Fatalf("check-host-access: %v", err)
+	}
+	out, err = captureStdout(t, func() error { return cmdActivate([]string{"bash"}) })
+	if err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	want := "export FOO='a b c'\nexport BAR='$(rm -rf /)'\nexport BAZ='it'\\''s'\n"
+	if out != want {
+		t.Errorf("activate bash printed\n%s\nwant\n%s", out, want)
+	}
+}
+
+// A second host adds its key, can't decrypt until a host that can runs
+// revalidate, and then reads the same secrets
+func TestAddSecondHostRevalidate(t *testing.T) {
+	h := newTestHost(t)
+	h.writeHosts(t, h.pubKey)
+	if err := encryptSecrets([]byte("FOO=bar\n")); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+
+	other, _ := writeTestKey(t, t.TempDir(), "id_ed25519", "otherhost")
+	h.use(t, other)
+	out, err := captureStdout(t, func() error { return cmdAddHost(nil) })
+	if err != nil {
+		t.Fatalf("add-this-host on the new host: %v", err)
+	}
+	if !strings.Contains(out, "revalidate") {
+		t.Errorf("add-this-host didn't say to revalidate:\n%s", out)
+	}
+	_, err = captureStdout(t, func() error { return cmdCheckHostAccess(nil) })
+	var code exitCode
+	if !errors.As(err, &code) || int(code) != accessCannotDecrypt {
+		t.Fatalf("check-host-access before revalidate = %v, want exit code %d", err, accessCannotDecrypt)
+	}
+
+	// The existing host grants access; the new key was added by someone
+	// else, so it has to be confirmed
+	h.use(t, h.key)
+	if _, err := captureStdout(t, func() error { return cmdRevalidate(nil) }); err == nil {
+		t.Fatal("revalidate granted a new host without confirmation")
+	}
+	assumeYes = true
+	if _, err := captureStdout(t, func() error { return cmdRevalidate(nil) }); err != nil {
+		t.Fatalf("revalidate: %v", err)
+	}
+
+	h.use(t, other)
+	if _, err := captureStdout(t, func() error { return cmdCheckHostAccess(nil) }); err != nil {
+		t.Fatalf("check-host-access after revalidate: %v", err)
+	}
+	content, err := decryptToBytes()
+	if err != nil {
+		t.Fatalf("decrypt on the new host: %v", err)
+	}
+	if string(content) != "FOO=bar\n" {
+		t.Errorf("new host read %q, want %q", content, "FOO=bar\n")
+	}
+}
+
+// A host that isn't in the hosts file is told so, and a host that is but
+// whose key changed can't decrypt
+func TestCheckHostAccess(t *testing.T) {
+	h := newTestHost(t)
+	h.writeHosts(t, h.pubKey)
+	if err := encryptSecrets([]byte("FOO=bar\n")); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+
+	stranger, _ := writeTestKey(t, t.TempDir(), "id_ed25519", "stranger")
+	h.use(t, stranger)
+	status, err := hostAccessStatus()
+	if err != nil || status != accessNotInHosts {
+		t.Errorf("stranger: hostAccessStatus = %d, %v; want %d", status, err, accessNotInHosts)
+	}
+
+	// The same name with a new key, listed but never encrypted to
+	rekeyed, pubKey := writeTestKey(t, t.TempDir(), "id_ed25519", "testhost")
+	h.writeHosts(t, h.pubKey, pubKey)
+	h.use(t, rekeyed)
+	status, err = hostAccessStatus()
+	if err != nil || status != accessCannotDecrypt {
+		t.Errorf("rekeyed: hostAccessStatus = %d, %v; want %d", status, err, accessCannotDecrypt)
+	}
+
+	h.use(t, h.key)
+	status, err = hostAccessStatus()
+	if err != nil || status != accessOK {
+		t.Errorf("original: hostAccessStatus = %d, %v; want %d", status, err, accessOK)
+	}
+}
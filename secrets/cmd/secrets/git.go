@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Commands that can change secrets.age or secrets.hosts, and so get
+// committed under --commit
+var writingCommands = map[string]bool{
+	"edit":          true,
+	"set":           true,
+	"unset":         true,
+	"import":        true,
+	"add-this-host": true,
+	"clone-access":  true,
+	"hosts":         true,
+	"revalidate":    true,
+	"reencrypt-all": true,
+	"rename-host":   true,
+	"merge-hosts":   true,
+	"rotate-key":    true,
+	"rekey":         true,
+}
+
+// Every secrets file encryptSecrets wrote, for commands like reencrypt-all
+// that switch between files
+var encryptedFiles []string
+
+// Run git in the secrets directory, returning its trimmed output
+func gitInSecretsPath(args ...string) (string, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", secretsPath}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err := timeoutError(ctx, "git "+args[0], err); errors.Is(err, errTimedOut) {
+		return "", err
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Fail unless SECRETS_PATH is inside a git work tree
+func requireGitRepo() error {
+	if _, err := gitInSecretsPath("rev-parse", "--is-inside-work-tree"); err != nil {
+		return fmt.Errorf("%s is not a git repository", secretsPath)
+	}
+	return nil
+}
+
+// Pull remote changes with rebase. age files can't be merged, so a conflict
+// aborts the rebase instead of leaving a broken secrets.age behind.
+func pullSecrets() error {
+	debugf("pulling %s", secretsPath)
+	_, err := gitInSecretsPath("pull", "--rebase", "--quiet")
+	if err == nil {
+		return nil
+	}
+	conflicts, _ := gitInSecretsPath("diff", "--name-only", "--diff-filter=U")
+	if conflicts == "" {
+		return err
+	}
+	if _, abortErr := gitInSecretsPath("rebase", "--abort"); abortErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", abortErr)
+	}
+	return fmt.Errorf("%s changed both here and on the remote; encrypted files can't be merged, so the pull was undone.\n"+
+		"To resolve, save the plaintext you want to keep with 'secrets export', reset %s to the\n"+
+		"remote version, then 'secrets import --replace' it on a host that can decrypt",
+		strings.Join(strings.Fields(conflicts), " and "), secretsPath)
+}
+
+// Push local commits to the remote
+func pushSecrets() error {
+	debugf("pushing %s", secretsPath)
+	_, err := gitInSecretsPath("push", "--quiet")
+	return err
+}
+
+// Commit secrets.age and secrets.hosts (and hosts.d, and any other secrets
+// file written) after command changed them. Only those paths are ever staged or
+// committed, so plaintext and anything else already staged stay out of the
+// commit.
+func commitSecrets(command string) error {
+	if _, err := gitInSecretsPath("rev-parse", "--is-inside-work-tree"); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not a git repository, not committing\n", secretsPath)
+		return nil
+	}
+
+	var paths []string
+	candidates := []string{secretsFile, secretsHosts, hostsSigPath(secretsHosts)}
+	if dir := hostsDirFor(secretsHosts); dir != "" {
+		candidates = append(candidates, dir)
+	}
+	for _, path := range append(candidates, encryptedFiles...) {
+		if slices.Contains(paths, filepath.Base(path)) {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, filepath.Base(path))
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	if _, err := gitInSecretsPath(append([]string{"add", "--"}, paths...)...); err != nil {
+		return err
+	}
+	changed, err := gitInSecretsPath(append([]string{"diff", "--cached", "--name-only", "--"}, paths...)...)
+	if err != nil {
+		return err
+	}
+	if changed == "" {
+		debugf("nothing to commit")
+		return nil
+	}
+	message := "secrets: " + command
+	if _, err := gitInSecretsPath(append([]string{"commit", "-q", "-m", message, "--"}, paths...)...); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Committed %s (%s)\n", strings.Join(strings.Fields(changed), " and "), message)
+	return nil
+}
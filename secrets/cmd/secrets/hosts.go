@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shardul/secrets"
+	"golang.org/x/crypto/ssh"
+)
+
+// Manage the hosts file from any machine, for hosts that can't run
+// add-this-host themselves yet
+func cmdHosts(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: secrets hosts add [--comment NAME] <pubkey-file|key>\n       secrets hosts sign\n       secrets hosts verify")
+	}
+	switch args[0] {
+	case "add":
+		return cmdHostsAdd(args[1:])
+	case "sign":
+		return cmdHostsSign(args[1:])
+	case "verify":
+		return cmdHostsVerify(args[1:])
+	default:
+		return fmt.Errorf("Unknown hosts command '%s'", args[0])
+	}
+}
+
+// Authorize another machine by its public key, given as a .pub file or the
+// key itself, and reencrypt if this host can decrypt
+func cmdHostsAdd(args []string) error {
+	fs := newFlagSet("hosts add")
+	comment := fs.String("comment", "", "Name to store for the host instead of the key's comment")
+	args = parseArgs(fs, args)
+	if len(args) == 0 {
+		return errors.New("Usage: secrets hosts add [--comment NAME] <pubkey-file|key>")
+	}
+
+	key, err := readHostKeyArg(args)
+	if err != nil {
+		return err
+	}
+	line, name, err := hostLineForKey(key, *comment)
+	if err != nil {
+		return err
+	}
+
+	if err := makeSecretsDir(); err != nil {
+		return err
+	}
+	hostsContent, err := readHosts(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+
+	material := strings.Fields(line)[0]
+	if hostsContainKey(hostsContent, []byte(line)) || (strings.HasPrefix(material, "age1") && hostsContainRecipient(hostsContent, material)) {
+		fmt.Println("This key is already authorized")
+		return nil
+	}
+
+	if err := addHostKey(hostsContent, []byte(line), name); err != nil {
+		return err
+	}
+	// Named on the command line, so reencrypting doesn't ask about it again
+	if added, _ := secrets.ParseHosts([]byte(line)); len(added) == 1 {
+		approvedGrants[added[0].Fingerprint] = true
+	}
+
+	// The new key belongs to another machine, so unlike add-this-host
+	// there's nothing to pull here afterwards
+	if secretsFileExists() {
+		if status, err := hostAccessStatus(); err != nil {
+			return err
+		} else if status == accessOK {
+			return revalidateLocally()
+		}
+		fmt.Printf("This host can't decrypt; run 'secrets revalidate' on one that can to give '%s' access\n", name)
+	}
+	return nil
+}
+
+// The key from a public key file when args name one, or args themselves
+// joined back into a key
+func readHostKeyArg(args []string) ([]byte, error) {
+	if len(args) == 1 {
+		content, err := readFile(args[0])
+		if err == nil {
+			content = bytes.TrimSpace(content)
+			if bytes.Contains(content, []byte("PRIVATE KEY")) {
+				return nil, fmt.Errorf("%s is a private key; give its .pub file instead", args[0])
+			}
+			if bytes.ContainsRune(content, '\n') {
+				return nil, fmt.Errorf("%s holds more than one line; give a single public key", args[0])
+			}
+			return content, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to read %s: %v", args[0], err)
+		}
+	}
+	return []byte(strings.TrimSpace(strings.Join(args, " "))), nil
+}
+
+// Check that key is an SSH public key or age recipient age can encrypt to,
+// and build its hosts file line, named by comment or else the key's own
+func hostLineForKey(key []byte, comment string) (line, name string, err error) {
+	var material string
+	if bytes.HasPrefix(key, []byte("age1")) {
+		fields := strings.Fields(string(key))
+		if recipients, _ := secrets.ParseHosts([]byte(fields[0])); len(recipients) != 1 {
+			return "", "", fmt.Errorf("Invalid age recipient %s", fields[0])
+		}
+		material, name = fields[0], strings.Join(fields[1:], " ")
+	} else {
+		pubKey, keyComment, _, _, err := ssh.ParseAuthorizedKey(key)
+		if err != nil {
+			return "", "", fmt.Errorf("Not an SSH public key or age recipient: %v", err)
+		}
+		if _, err := secrets.NewSSHRecipient(pubKey); err != nil {
+			return "", "", fmt.Errorf("Can't encrypt to this key: %v", err)
+		}
+		material, name = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))), keyComment
+	}
+
+	if comment != "" {
+		name = comment
+	}
+	// The name is the last field of the hosts line and what old keys are
+	// matched on, so it has to be a single word that can't start a
+	// description
+	if name == "" {
+		return "", "", errors.New("The key has no comment to name the host; pass --comment NAME")
+	}
+	if strings.ContainsAny(name, " \t\r\n#") {
+		return "", "", fmt.Errorf("Invalid host name %q: use --comment with a single word without '#'", name)
+	}
+	return material + " " + name, name, nil
+}
+
+// Add a key to the hosts file under name, offering to replace any keys
+// already stored under that name. With a hosts.d directory the key goes in
+// its own file there instead.
+func addHostKey(hostsContent, key []byte, name string) error {
+	if dir := hostsDirFor(secretsHosts); dir != "" {
+		return addHostKeyFile(dir, key, name)
+	}
+
+	oldKeys, newContent := hostsWithKey(hostsContent, key, name)
+	if len(oldKeys) > 0 {
+		fmt.Printf("Found existing key(s) for host '%s':\n", name)
+		for _, old := range oldKeys {
+			fmt.Println(old)
+		}
+		fmt.Println()
+
+		if !confirm("Remove old key(s) and add new one?") {
+			fmt.Println("Operation cancelled")
+			return exitCode(1)
+		}
+		if err := writeHostsFile(newContent); err != nil {
+			return errors.New("Failed to update hosts file")
+		}
+		fmt.Println("Old key(s) removed and new key added successfully")
+		return nil
+	}
+
+	if err := writeHostsFile(newContent); err != nil {
+		return errors.New("Failed to update hosts file")
+	}
+	fmt.Println("Host key added successfully")
+	return nil
+}
+
+// The lines of keys already stored under name, and the hosts file with
+// them replaced by key (or with key appended, if there are none)
+func hostsWithKey(hostsContent, key []byte, name string) (oldKeys []string, newContent []byte) {
+	lines := strings.Split(string(hostsContent), "\n")
+	for _, line := range lines {
+		if k, _ := secrets.SplitHostLine(line); hostKeyComment(k) == name {
+			oldKeys = append(oldKeys, line)
+		}
+	}
+
+	if len(oldKeys) == 0 {
+		newContent = append([]byte{}, hostsContent...)
+		if len(newContent) > 0 && !bytes.HasSuffix(newContent, []byte("\n")) {
+			newContent = append(newContent, '\n')
+		}
+		return nil, append(append(newContent, key...), '\n')
+	}
+
+	var newLines []string
+	for _, line := range lines {
+		if k, _ := secrets.SplitHostLine(line); hostKeyComment(k) != name && line != "" {
+			newLines = append(newLines, line)
+		}
+	}
+	newLines = append(newLines, string(key))
+	return oldKeys, []byte(strings.Join(newLines, "\n") + "\n")
+}
+
+// Print what addHostKey would change, without writing anything
+func previewHostKey(hostsContent, key []byte, name string) {
+	if dir := hostsDirFor(secretsHosts); dir != "" {
+		path := filepath.Join(dir, name+".pub")
+		if old, err := readFile(path); err == nil {
+			fmt.Printf("Would replace the key(s) in %s:\n%s\n\n", path, strings.TrimSpace(string(old)))
+		}
+		fmt.Printf("Would write %s:\n%s\n", path, key)
+		return
+	}
+
+	oldKeys, newContent := hostsWithKey(hostsContent, key, name)
+	fmt.Printf("Would add:\n%s\n", key)
+	if len(oldKeys) > 0 {
+		fmt.Printf("\nWould remove %d old key(s) for host '%s' (after asking):\n", len(oldKeys), name)
+		for _, old := range oldKeys {
+			fmt.Println(old)
+		}
+	}
+	fmt.Printf("\nResulting %s:\n%s", secretsHosts, newContent)
+}
+
+// Add the hosts in another hosts file that aren't already authorized,
+// matching keys by fingerprint so the same key under another name or with
+// another description isn't added twice, and reencrypt to the result
+func cmdMergeHosts(args []string) error {
+	fs := newFlagSet("merge-hosts")
+	dryRun := fs.Bool("dry-run", false, "Show the hosts that would be added without changing anything")
+	if args = parseArgs(fs, args); len(args) != 1 {
+		return errors.New("Usage: secrets merge-hosts [--dry-run] <other.hosts>")
+	}
+	otherPath := args[0]
+
+	otherContent, err := readFile(otherPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", otherPath, err)
+	}
+	hostsContent, err := readFile(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+	// Keys in hosts.d count as authorized too
+	allHosts, err := readHosts(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+
+	known := make(map[string]bool)
+	names := make(map[string]string)
+	current, _ := secrets.ParseHosts(allHosts)
+	for _, r := range current {
+		known[r.Fingerprint] = true
+		names[r.Comment] = r.Fingerprint
+	}
+
+	// Copies of a key within secrets.hosts itself go too, first one kept
+	deduped, dropped := dedupHosts(hostsContent)
+
+	var added []string
+	for i, line := range strings.Split(string(otherContent), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parsed, _ := secrets.ParseHosts([]byte(line))
+		if len(parsed) != 1 {
+			fmt.Fprintf(os.Stderr, "Warning: skipping unusable host on line %d of %s: %s\n", i+1, otherPath, line)
+			continue
+		}
+		r := parsed[0]
+		if known[r.Fingerprint] {
+			debugf("%s line %d is already authorized", otherPath, i+1)
+			continue
+		}
+		if fingerprint, ok := names[r.Comment]; ok && r.Comment != "" {
+			fmt.Fprintf(os.Stderr, "Warning: host '%s' has a different key in %s (line %d) than %s; keeping both\n", r.Comment, otherPath, i+1, fingerprint)
+		}
+		known[r.Fingerprint] = true
+		names[r.Comment] = r.Fingerprint
+		added = append(added, line)
+	}
+
+	if len(added) == 0 && dropped == 0 {
+		fmt.Printf("Every host in %s is already authorized\n", otherPath)
+		return nil
+	}
+	if len(added) > 0 {
+		fmt.Printf("Host(s) from %s to add:\n", otherPath)
+		for _, line := range added {
+			fmt.Println(line)
+		}
+	}
+	if dropped > 0 {
+		fmt.Printf("Duplicate key(s) to remove from %s: %d\n", secretsHosts, dropped)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// Re-encryption needs the plaintext, so check access before changing
+	// anything
+	exists := secretsFileExists()
+	if exists {
+		if err := requireAccess(); err != nil {
+			return err
+		}
+	}
+
+	merged := deduped
+	if len(merged) > 0 && !bytes.HasSuffix(merged, []byte("\n")) {
+		merged = append(merged, '\n')
+	}
+	merged = append(merged, []byte(strings.Join(added, "\n"))...)
+	if len(added) > 0 {
+		merged = append(merged, '\n')
+	}
+	if err := makeSecretsDir(); err != nil {
+		return err
+	}
+	if err := writeHostsFile(merged); err != nil {
+		return errors.New("Failed to update hosts file")
+	}
+
+	// Reencrypting asks about each newly granted host; turning one down
+	// puts the hosts file back
+	if exists {
+		if err := revalidateLocally(); err != nil {
+			if restoreErr := writeHostsFile(hostsContent); restoreErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to restore hosts file: %v\n", restoreErr)
+			}
+			return err
+		}
+	}
+	fmt.Printf("Merged %d host(s) into %s\n", len(added), secretsHosts)
+	return nil
+}
+
+// The hosts file without repeated keys, keeping each key's first line and
+// every comment and blank line, and how many lines were dropped
+func dedupHosts(hostsContent []byte) ([]byte, int) {
+	seen := make(map[string]bool)
+	var lines []string
+	dropped := 0
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		if parsed, _ := secrets.ParseHosts([]byte(line)); len(parsed) == 1 {
+			if seen[parsed[0].Fingerprint] {
+				dropped++
+				continue
+			}
+			seen[parsed[0].Fingerprint] = true
+		}
+		lines = append(lines, line)
+	}
+	return []byte(strings.Join(lines, "\n")), dropped
+}
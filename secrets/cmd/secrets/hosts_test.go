@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A host's old keys are found by their whole comment, never by a name that
+// merely ends or starts with it
+func TestHostsWithKey(t *testing.T) {
+	dir := t.TempDir()
+	key := func(name string) string {
+		_, pub := writeTestKey(t, dir, name, name)
+		return string(bytes.TrimSpace(pub))
+	}
+	laptop, myLaptop, laptop2 := key("laptop"), key("my-laptop"), key("laptop2")
+	described := key("laptop") + " # group:work"
+	age := "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p laptop-old"
+	newKey := key("laptop")
+
+	tests := []struct {
+		name  string
+		hosts []string
+		old   []string
+	}{
+		{"no keys", nil, nil},
+		{"same name", []string{myLaptop, laptop, laptop2}, []string{laptop}},
+		{"suffix and prefix only", []string{myLaptop, laptop2}, nil},
+		{"name with a description", []string{described, myLaptop}, []string{described}},
+		{"age recipient with a longer name", []string{age, myLaptop}, nil},
+		{"several old keys", []string{laptop, myLaptop, described}, []string{laptop, described}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hostsContent []byte
+			if len(tt.hosts) > 0 {
+				hostsContent = []byte(strings.Join(tt.hosts, "\n") + "\n")
+			}
+			old, newContent := hostsWithKey(hostsContent, []byte(newKey), "laptop")
+			if strings.Join(old, "\n") != strings.Join(tt.old, "\n") {
+				t.Errorf("old keys = %q, want %q", old, tt.old)
+			}
+
+			// Every other host keeps its line, and the new key is added once
+			lines := strings.Split(strings.TrimSuffix(string(newContent), "\n"), "\n")
+			kept := make(map[string]bool)
+			for _, line := range lines {
+				kept[line] = true
+			}
+			for _, line := range tt.hosts {
+				isOld := false
+				for _, o := range tt.old {
+					isOld = isOld || o == line
+				}
+				if kept[line] == isOld {
+					t.Errorf("line %q kept = %v, want %v", line, kept[line], !isOld)
+				}
+			}
+			if lines[len(lines)-1] != newKey || strings.Count(string(newContent), newKey) != 1 {
+				t.Errorf("new key not added once at the end:\n%s", newContent)
+			}
+		})
+	}
+}
+
+func TestHostKeyComment(t *testing.T) {
+	_, pub := writeTestKey(t, t.TempDir(), "id", "work-laptop")
+	tests := []struct {
+		key, want string
+	}{
+		{string(bytes.TrimSpace(pub)), "work-laptop"},
+		{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p nas", "nas"},
+		{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p", ""},
+		{"ssh-ed25519 not-base64 laptop", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := hostKeyComment(tt.key); got != tt.want {
+			t.Errorf("hostKeyComment(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+// Renaming only rewrites the hosts file; the secrets file is untouched and
+// still readable by the renamed host
+func TestRenameHost(t *testing.T) {
+	h := newTestHost(t)
+	_, other := writeTestKey(t, t.TempDir(), "id_ed25519", "my-laptop")
+	h.writeHosts(t, h.pubKey, other)
+	if err := encryptSecrets([]byte("FOO=bar\n")); err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+	before, err := os.ReadFile(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.use(t, h.key)
+	if _, err := captureStdout(t, func() error { return cmdRenameHost([]string{"testhost", "laptop"}) }); err != nil {
+		t.Fatalf("rename-host: %v", err)
+	}
+
+	after, err := os.ReadFile(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("rename-host rewrote the secrets file")
+	}
+	hostsContent, err := os.ReadFile(secretsHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(hostsContent)), "\n") {
+		names = append(names, hostKeyComment(line))
+	}
+	if strings.Join(names, ",") != "laptop,my-laptop" {
+		t.Errorf("hosts are %q after renaming, want laptop and my-laptop", names)
+	}
+
+	h.use(t, h.key)
+	if status, err := hostAccessStatus(); err != nil || status != accessOK {
+		t.Errorf("hostAccessStatus after renaming = %d, %v; want ok", status, err)
+	}
+	if err := cmdRenameHost([]string{"nosuchhost", "x"}); err == nil {
+		t.Error("renaming a missing host succeeded")
+	}
+}
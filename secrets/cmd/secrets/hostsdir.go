@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shardul/secrets"
+)
+
+// Optional hosts.d directory next to secrets.hosts holding one NAME.pub file
+// per machine, which merges in git far better than one shared file. When it
+// exists the hosts are everything in secrets.hosts followed by every
+// hosts.d/*.pub in name order, a key listed in both being used once, and
+// new hosts are written to hosts.d instead of secrets.hosts.
+const hostsDirName = "hosts.d"
+
+// The hosts.d directory that goes with the hosts file at path, or "" if
+// there is none. Only the shared secrets.hosts has one.
+func hostsDirFor(path string) string {
+	if filepath.Base(path) != "secrets.hosts" {
+		return ""
+	}
+	dir := filepath.Join(filepath.Dir(path), hostsDirName)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// The .pub files in a hosts.d directory, in name order
+func hostsDirFiles(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*.pub"))
+}
+
+// Read the hosts file at path followed by its hosts.d files, as the one
+// hosts file they make up together. Without a hosts.d this is just the
+// file; with one, a missing file is no error.
+func readHosts(path string) ([]byte, error) {
+	content, err := readFile(path)
+	dir := hostsDirFor(path)
+	if dir == "" {
+		return content, err
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	files, err := hostsDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		pub, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			content = append(content, '\n')
+		}
+		content = append(content, pub...)
+	}
+	return content, nil
+}
+
+// Whether there is any hosts file to read at path, counting a hosts.d
+func hostsExist(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	return hostsDirFor(path) != ""
+}
+
+// Write key to hosts.d/<name>.pub, asking before replacing a key already
+// stored there
+func addHostKeyFile(dir string, key []byte, name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("Invalid host name %q for a file in %s", name, dir)
+	}
+	path := filepath.Join(dir, name+".pub")
+
+	if old, err := readFile(path); err == nil {
+		fmt.Printf("Found existing key(s) for host '%s' in %s:\n", name, path)
+		fmt.Println(strings.TrimSpace(string(old)))
+		fmt.Println()
+		if !confirm("Replace them with the new one?") {
+			fmt.Println("Operation cancelled")
+			return exitCode(1)
+		}
+	}
+	if err := writeHostKeyFile(path, key); err != nil {
+		return errors.New("Failed to write " + path)
+	}
+	fmt.Printf("Host key added as %s\n", filepath.Join(hostsDirName, name+".pub"))
+
+	// Keys of the same name in secrets.hosts still count; say so rather
+	// than editing the shared file behind the user's back
+	if hostsContent, err := readFile(secretsHosts); err == nil {
+		for _, line := range strings.Split(string(hostsContent), "\n") {
+			if k, _ := secrets.SplitHostLine(strings.TrimSpace(line)); k != "" && hostKeyComment(k) == name {
+				fmt.Printf("Note: %s also lists a key for '%s', which keeps its access until removed\n", secretsHosts, name)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Atomically write a hosts.d file holding key
+func writeHostKeyFile(path string, key []byte) error {
+	return secrets.WriteFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := w.Write(append(bytes.TrimSpace(key), '\n'))
+		return err
+	})
+}
+
+// The hosts.d files holding a key that match matches, with their contents
+// by path so they can be restored if they're removed and a later step fails
+func hostKeyFilesMatching(dir string, match func(key string) bool) (map[string][]byte, error) {
+	files, err := hostsDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	matched := make(map[string][]byte)
+	for _, file := range files {
+		content, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if key, _ := secrets.SplitHostLine(strings.TrimSpace(line)); key != "" && !strings.HasPrefix(key, "#") && match(key) {
+				matched[file] = content
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// Remove hosts.d files found by hostKeyFilesMatching, putting them all back
+// if one can't be removed
+func removeHostKeyFiles(files map[string][]byte) error {
+	for path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			restoreHostKeyFiles(files)
+			return err
+		}
+	}
+	return nil
+}
+
+// Put back hosts.d files taken out by removeHostKeyFiles
+func restoreHostKeyFiles(removed map[string][]byte) {
+	for path, content := range removed {
+		if err := writeHostKeyFile(path, content); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to restore %s: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,3422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/shardul/secrets"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	secretsPath string
+	// Base name of the .age and .hosts files in secretsPath (--file)
+	secretsName  = "secrets"
+	secretsID    string
+	secretsFile  string
+	secretsHosts string
+	secretsAgeID string
+)
+
+// Fingerprints of hosts the user added in this run (hosts add, agent keys),
+// which encryptSecrets grants access to without asking again
+var approvedGrants = make(map[string]bool)
+
+// Global flags, accepted before or after the command name
+var (
+	strict      bool
+	allowAnyKey bool
+	verbose     bool
+	mask        = os.Getenv("SECRETS_MASK") == "1"
+	backup      bool
+	assumeYes   bool
+
+	// Hosts file to encrypt to instead of secrets.hosts
+	recipientsFile string
+	// Only encrypt to the hosts file, even if this host isn't in it
+	noSelf bool
+	// Commit changed secrets files when SECRETS_PATH is a git repository
+	autoCommit = os.Getenv("SECRETS_AUTOCOMMIT") == "1"
+	// Kill the editor and other external commands after this long; 0 waits
+	commandTimeout time.Duration
+	// Write ASCII-armored age files
+	armorOutput bool
+
+	// CI systems set CI=true; never block on stdin there
+	nonInteractive = os.Getenv("CI") == "true"
+)
+
+// Number of secrets.age backups kept by --backup unless SECRETS_BACKUPS is set
+const defaultBackups = 5
+
+// SSH keys under ~/.ssh tried in order when no key is given explicitly.
+// age has no ECDSA support, so id_ecdsa is skipped unless it parses.
+var sshKeyCandidates = []string{"id_ed25519", "id_rsa", "id_ecdsa"}
+
+// Where the tool finds its files. Commands only read the package-level paths
+// that useConfig derives from this, so a caller can point them at any
+// directory and key without touching the environment. The age identity file
+// is left to setSecretsPath: $AGE_IDENTITY, or identity.age in SecretsPath.
+type config struct {
+	SecretsPath string
+	SecretsID   string
+	// Selects NAME.age and NAME.hosts in SecretsPath; "secrets" when empty
+	File string
+}
+
+// Resolve the secrets directory and identity paths. Called from main once
+// global flags are parsed, so --secrets-path and --key can override the
+// environment.
+func setupPaths() error {
+	c, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	return useConfig(c)
+}
+
+// Build the config from the global flags, falling back to the environment
+func configFromEnv() (config, error) {
+	c := config{SecretsPath: secretsPath, SecretsID: secretsID, File: secretsName}
+	if c.SecretsPath == "" {
+		c.SecretsPath = os.Getenv("SECRETS_PATH")
+	}
+	if c.SecretsPath == "" {
+		return c, errors.New("SECRETS_PATH environment variable or --secrets-path must be set")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return c, err
+	}
+
+	if c.SecretsID == "" {
+		c.SecretsID = os.Getenv("SECRETS_ID")
+	}
+	if c.SecretsID == "" {
+		c.SecretsID = findSSHKey(home)
+	}
+	return c, nil
+}
+
+// Point every command at the files described by c
+func useConfig(c config) error {
+	if c.SecretsPath == "" {
+		return errors.New("no secrets directory configured")
+	}
+	secretsID = c.SecretsID
+	secretsName = "secrets"
+	if c.File != "" {
+		if err := checkSecretsName(c.File); err != nil {
+			return err
+		}
+		secretsName = c.File
+	}
+	if err := setSecretsPath(c.SecretsPath); err != nil {
+		return err
+	}
+	debugf("secrets directory %s, SSH key %s, age identity %s", secretsPath, secretsID, secretsAgeID)
+	return nil
+}
+
+// Point the tool at a secrets directory, recomputing the paths inside it
+func setSecretsPath(path string) error {
+	secretsPath = path
+	secretsFile = filepath.Join(secretsPath, secretsName+".age")
+	secretsHosts = filepath.Join(secretsPath, secretsName+".hosts")
+
+	// secrets.yaml can encrypt this file to groups from secrets.hosts
+	rules, err := loadRules(secretsPath)
+	if err != nil {
+		return err
+	}
+	fileGroups = nil
+	if rules != nil {
+		if groups := rules.groupsFor(secretsName); groups != nil {
+			fileGroups = groups
+			secretsHosts = filepath.Join(secretsPath, "secrets.hosts")
+			debugf("%s.age is encrypted to group(s) %s", secretsName, strings.Join(groups, ", "))
+		}
+	}
+
+	// An age identity file can be used alongside (or instead of) the SSH key
+	secretsAgeID = os.Getenv("AGE_IDENTITY")
+	if secretsAgeID == "" {
+		secretsAgeID = filepath.Join(secretsPath, "identity.age")
+	}
+	return nil
+}
+
+// Switch to NAME.age and NAME.hosts for --file
+func setSecretsName(name string) error {
+	if err := checkSecretsName(name); err != nil {
+		return err
+	}
+	secretsName = name
+	// Before setupPaths has run there is nothing to recompute yet
+	if secretsPath == "" {
+		return nil
+	}
+	return setSecretsPath(secretsPath)
+}
+
+// A --file name must stay inside the secrets directory
+func checkSecretsName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid secrets file name %q", name)
+	}
+	return nil
+}
+
+// Create a flag set for a command with the global flags registered on it
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	// Defaults are the current values so flags given before the command
+	// name survive the command's own flag set being parsed
+	fs.BoolVar(&strict, "strict", strict, "Fail instead of skipping unparseable hosts")
+	fs.BoolVar(&allowAnyKey, "allow-any-key", allowAnyKey, "Accept key names that aren't valid shell identifiers")
+	fs.StringVar(&secretsID, "key", secretsID, "SSH private key to use as this host's identity")
+	fs.Func("secrets-path", "Directory holding secrets.age and secrets.hosts (default $SECRETS_PATH)", setSecretsPath)
+	fs.Func("file", "Use NAME.age and NAME.hosts in the secrets directory (default secrets)", setSecretsName)
+	fs.StringVar(&recipientsFile, "recipients-file", recipientsFile, "Hosts file to encrypt to instead of secrets.hosts")
+	fs.BoolVar(&noSelf, "no-self", noSelf, "Don't add this host's key as a recipient unless the hosts file lists it")
+	fs.BoolVar(&autoCommit, "commit", autoCommit, "Commit changed secrets files in SECRETS_PATH with git")
+	fs.DurationVar(&commandTimeout, "timeout", commandTimeout, "Kill the editor, ssh-keygen and other external commands after this long (e.g. 10m)")
+	fs.BoolVar(&armorOutput, "armor", armorOutput, "Write ASCII-armored (PEM) age files")
+	fs.BoolVar(&backup, "backup", backup, "Keep a timestamped copy of secrets.age before overwriting it")
+	fs.Func("dir-mode", "Mode to create the secrets directory with, before the umask (default 0700)", setDirMode)
+	fs.BoolVar(&assumeYes, "yes", assumeYes, "Answer yes to every question")
+	fs.BoolVar(&assumeYes, "y", assumeYes, "Shorthand for --yes")
+	fs.BoolVar(&nonInteractive, "non-interactive", nonInteractive, "Never prompt; answer no to every question (default when CI=true)")
+	fs.BoolVar(&noColor, "no-color", noColor, "Don't color messages, even on a terminal")
+	fs.BoolVar(&mask, "mask", mask, "Mask secret values in human-facing output")
+	fs.BoolVar(&verbose, "verbose", verbose, "Log what the tool is doing to stderr")
+	fs.BoolVar(&verbose, "v", verbose, "Shorthand for --verbose")
+	return fs
+}
+
+// Parse flags interspersed with positional arguments, which the flag
+// package alone stops at. Everything after "--" is positional.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Print a diagnostic line to stderr when --verbose is set
+func debugf(format string, args ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "secrets: "+format+"\n", args...)
+	}
+}
+
+// Find the first candidate SSH key that parses as an age identity. Falls back
+// to id_ed25519 so a missing key can still be generated there.
+func findSSHKey(home string) string {
+	for _, name := range sshKeyCandidates {
+		path := filepath.Join(home, ".ssh", name)
+		privateKeyBytes, err := readFile(path)
+		if err != nil {
+			continue
+		}
+		// A passphrase-protected key counts; it's unlocked when used
+		_, err = agessh.ParseIdentity(privateKeyBytes)
+		var missing *ssh.PassphraseMissingError
+		if err == nil || errors.As(err, &missing) {
+			return path
+		}
+	}
+	return filepath.Join(home, ".ssh", sshKeyCandidates[0])
+}
+
+func die(msg string) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, ansiRed, "Error:"), msg)
+	os.Exit(1)
+}
+
+// An error that has already been reported to the user, carrying the exit
+// status main should use
+type exitCode int
+
+func (e exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// Exit codes for failures scripts may want to tell apart. Access problems
+// exit with their status (1-3, see check-host-access) and anything else
+// with 1.
+const (
+	exitNoIdentity    = 10 // No usable key or age identity
+	exitDecryptFailed = 11 // The secrets file couldn't be decrypted
+	exitInvalid       = 12 // Secrets content failed validation
+)
+
+// An error main reports before exiting with code
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e codedError) Error() string { return e.err.Error() }
+func (e codedError) Unwrap() error { return e.err }
+
+// Turn an access status into the error that makes it the exit code
+func accessError(status int) error {
+	if status == accessOK {
+		return nil
+	}
+	return exitCode(status)
+}
+
+var errTimedOut = errors.New("timed out")
+
+// Context for an external command, cancelled after --timeout if one is set
+func commandContext() (context.Context, context.CancelFunc) {
+	if commandTimeout > 0 {
+		return context.WithTimeout(context.Background(), commandTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Return err, or errTimedOut naming what was killed if ctx ran out first
+func timeoutError(ctx context.Context, what string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s was killed after --timeout %v: %w", what, commandTimeout, errTimedOut)
+	}
+	return err
+}
+
+// Run ssh-keygen with output on this terminal
+func runKeygen(args ...string) error {
+	ctx, cancel := commandContext()
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ssh-keygen", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := timeoutError(ctx, "ssh-keygen", cmd.Run()); err != nil {
+		if errors.Is(err, errTimedOut) {
+			return fmt.Errorf("Failed to generate SSH key: %w", err)
+		}
+		return errors.New("Failed to generate SSH key")
+	}
+	return nil
+}
+
+func ensureSecretsID() error {
+	pubKeyPath := secretsID + ".pub"
+	if _, err := os.Stat(pubKeyPath); os.IsNotExist(err) {
+		if confirm("OK to generate a " + secretsID + " key?") {
+			fmt.Println("Generating secrets ID...")
+			if err := runKeygen("-t", "ed25519", "-f", secretsID, "-N", ""); err != nil {
+				return err
+			}
+			fmt.Println("Secrets ID generated")
+			// Scripted runs carry on with the command that needed the key
+			if !assumeYes {
+				return exitCode(0)
+			}
+		} else if nonInteractive {
+			return codedError{exitNoIdentity, fmt.Errorf("No public key at %s; pass --yes to generate one or --key to use another", pubKeyPath)}
+		} else {
+			return errors.New("Aborting")
+		}
+	}
+	return nil
+}
+
+// Ask a yes/no question on stdin, defaulting to no. --yes answers yes to
+// everything; otherwise --non-interactive answers no without asking.
+func confirm(prompt string) bool {
+	if assumeYes {
+		fmt.Fprintf(os.Stderr, "%s [y/N] yes (--yes)\n", prompt)
+		return true
+	}
+	if nonInteractive {
+		fmt.Fprintf(os.Stderr, "%s [y/N] no (non-interactive)\n", prompt)
+		return false
+	}
+
+	fmt.Print(prompt + " [y/N] ")
+	reader := bufio.NewReader(os.Stdin)
+	reply, _ := reader.ReadString('\n')
+	reply = strings.TrimSpace(strings.ToLower(reply))
+	return reply == "y" || reply == "yes"
+}
+
+func readFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// Overwrite a plaintext buffer, up to its capacity, once it's no longer
+// needed. Copies made along the way may survive, but this shortens the time
+// secrets sit in memory waiting to be garbage collected.
+func zero(b []byte) {
+	clear(b[:cap(b)])
+}
+
+func writeFile(path string, data []byte) error {
+	return os.WriteFile(path, data, 0600)
+}
+
+// Atomically replace the hosts file
+func writeHostsFile(data []byte) error {
+	return secrets.WriteFileAtomic(secretsHosts, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Directory for plaintext temp files. $XDG_RUNTIME_DIR and /dev/shm are
+// memory-backed on Linux, so prefer them to keep plaintext off persistent
+// storage; an empty result means the system temp dir.
+func secureTempDir() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if dir == "" {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Create a 0600 temp file for plaintext secrets in secureTempDir
+func createSecureTemp() (*os.File, error) {
+	f, err := os.CreateTemp(secureTempDir(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	debugf("plaintext temp file %s", f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load SSH identity for age encryption/decryption
+func loadSSHIdentity() (age.Identity, error) {
+	debugf("using SSH identity %s", secretsID)
+	privateKeyBytes, err := readFile(secretsID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+	warnLoosePermissions(secretsID)
+
+	identity, err := agessh.ParseIdentity(privateKeyBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return loadEncryptedSSHIdentity(secretsID, privateKeyBytes, missing.PublicKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH identity: %w", err)
+	}
+
+	return identity, nil
+}
+
+// Wrap a passphrase-protected SSH key so the passphrase is only asked for
+// if the key is actually needed to decrypt
+func loadEncryptedSSHIdentity(path string, privateKeyBytes []byte, pubKey ssh.PublicKey) (age.Identity, error) {
+	// Older key formats don't embed the public key, so fall back to the .pub
+	if pubKey == nil {
+		pubKeyBytes, err := readFile(path + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("key is passphrase protected and its public key is unreadable: %w", err)
+		}
+		if pubKey, _, _, _, err = ssh.ParseAuthorizedKey(pubKeyBytes); err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+	}
+
+	identity, err := agessh.NewEncryptedSSHIdentity(pubKey, privateKeyBytes, func() ([]byte, error) {
+		return readPassphrase(fmt.Sprintf("Enter passphrase for %s: ", path))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encrypted SSH identity: %w", err)
+	}
+	return identity, nil
+}
+
+// Read a key passphrase without echo from the terminal, or from the
+// $SSH_ASKPASS program when there is no terminal or SSH_ASKPASS_REQUIRE
+// asks for it (same rules as ssh)
+func readPassphrase(prompt string) ([]byte, error) {
+	askpass := os.Getenv("SSH_ASKPASS")
+	require := os.Getenv("SSH_ASKPASS_REQUIRE")
+
+	tty, ttyErr := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if askpass != "" && require != "never" && (ttyErr != nil || require == "force" || require == "prefer") {
+		if ttyErr == nil {
+			tty.Close()
+		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		out, err := exec.CommandContext(ctx, askpass, prompt).Output()
+		if err := timeoutError(ctx, askpass, err); err != nil {
+			return nil, fmt.Errorf("%s failed: %w", askpass, err)
+		}
+		return bytes.TrimRight(out, "\r\n"), nil
+	}
+
+	if ttyErr != nil {
+		return nil, fmt.Errorf("no terminal to read the passphrase from (set SSH_ASKPASS): %w", ttyErr)
+	}
+	defer tty.Close()
+	if nonInteractive {
+		return nil, fmt.Errorf("key is passphrase protected and --non-interactive is set (set SSH_ASKPASS)")
+	}
+
+	fmt.Fprint(tty, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return passphrase, err
+}
+
+// Read a secret value from the terminal without echoing it
+func readSecretValue(prompt string) (string, error) {
+	if nonInteractive {
+		return "", errors.New("can't prompt for a value: --non-interactive is set")
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to read from: %w", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	value, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	defer zero(value)
+	return string(value), nil
+}
+
+// Prompt for the passphrase of --passphrase mode, twice when encrypting so
+// a typo doesn't lock the data away
+func promptPassphrase(confirmIt bool) (string, error) {
+	passphrase, err := readSecretValue("Passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the passphrase can't be empty")
+	}
+	if !confirmIt {
+		return passphrase, nil
+	}
+	again, err := readSecretValue("Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("the passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// Load age identities (AGE-SECRET-KEY-... or AGE-PLUGIN-...) from an
+// identity file
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	content, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(content)
+	warnLoosePermissions(path)
+
+	identities, err := parseAgeIdentities(content, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identity file: %w", err)
+	}
+
+	return identities, nil
+}
+
+// Identities loaded by loadIdentities, kept for the rest of the process so a
+// passphrase-protected key is only unlocked once per invocation
+var loadedIdentities []age.Identity
+
+// Load every identity available for decryption: the SSH key and the age
+// identity file. A missing file is skipped as long as at least one is found.
+func loadIdentities() ([]age.Identity, error) {
+	if loadedIdentities != nil {
+		return loadedIdentities, nil
+	}
+
+	var identities []age.Identity
+
+	sshKeyUsable := false
+	if _, err := os.Stat(secretsID); err == nil {
+		identity, err := loadSSHIdentity()
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+		_, locked := identity.(*agessh.EncryptedSSHIdentity)
+		sshKeyUsable = !locked
+	}
+
+	// Fall back to ssh-agent when the key isn't on disk or needs a
+	// passphrase, trying it first so the passphrase is only asked for
+	// if the agent can't decrypt
+	if !sshKeyUsable {
+		agentIDs, err := loadAgentIdentities()
+		if err != nil {
+			debugf("%v", err)
+		}
+		var fromAgent []age.Identity
+		for _, id := range agentIDs {
+			fromAgent = append(fromAgent, id.identity)
+		}
+		if len(fromAgent) > 0 {
+			warnForwardedAgent()
+		}
+		identities = append(fromAgent, identities...)
+	}
+
+	ageIdentities, err := loadAgeIdentities(secretsAgeID)
+	if err != nil && !(os.IsNotExist(err) && os.Getenv("AGE_IDENTITY") == "") {
+		return nil, fmt.Errorf("failed to load age identity: %w", err)
+	}
+	if len(ageIdentities) > 0 {
+		debugf("using %d age identity(s) from %s", len(ageIdentities), secretsAgeID)
+	}
+	identities = append(identities, ageIdentities...)
+
+	if len(identities) == 0 {
+		return nil, codedError{exitNoIdentity, fmt.Errorf("no identity found (tried %s and %s)", secretsID, secretsAgeID)}
+	}
+
+	loadedIdentities = identities
+	return identities, nil
+}
+
+// Load recipients from a hosts file, warning about lines that can't be
+// used (or failing on them under --strict). With groups, only hosts in
+// those secrets.yaml groups are returned.
+func loadSSHRecipients(path string, groups []string) ([]secrets.Recipient, error) {
+	hostsContent, err := readHosts(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	recipients, skipped := secrets.ParseHosts(hostsContent)
+	recipients = dedupRecipients(recipients, path)
+	debugf("loaded %d recipient(s) from %s", len(recipients), path)
+	for _, r := range recipients {
+		debugf("  recipient %s %s", r.Fingerprint, r.Comment)
+	}
+	if len(skipped) > 0 {
+		if strict {
+			return nil, fmt.Errorf("invalid hosts file (--strict):\n  %s", strings.Join(skipped, "\n  "))
+		}
+		for _, msg := range skipped {
+			fmt.Fprintf(os.Stderr, "Warning: skipped %s\n", msg)
+		}
+	}
+
+	if groups != nil {
+		return filterGroups(recipients, groups, path)
+	}
+
+	return recipients, nil
+}
+
+// Drop recipients whose key is already listed earlier in the hosts file,
+// usually a copy-pasted line, which would otherwise add a second stanza for
+// the same key to every file
+func dedupRecipients(recipients []secrets.Recipient, path string) []secrets.Recipient {
+	seen := make(map[string]string)
+	var unique []secrets.Recipient
+	for _, r := range recipients {
+		if first, ok := seen[r.Fingerprint]; ok {
+			names := "'" + first + "'"
+			if first != r.Comment {
+				names += " and '" + r.Comment + "'"
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %s lists the key %s twice (%s), using it once\n", path, r.Fingerprint, names)
+			continue
+		}
+		seen[r.Fingerprint] = r.Comment
+		unique = append(unique, r)
+	}
+	return unique
+}
+
+// The comment of a key from the hosts file, which names the host. Compared
+// whole, so a host named laptop doesn't match my-laptop.
+func hostKeyComment(key string) string {
+	if strings.HasPrefix(key, "age1") {
+		return strings.Join(strings.Fields(key)[1:], " ")
+	}
+	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return ""
+	}
+	return comment
+}
+
+// Report whether the hosts file lists the given public key. Only the key
+// material is compared, so a host whose comment was renamed still matches.
+func hostsContainKey(hostsContent, pubKeyBytes []byte) bool {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		key, _ := secrets.SplitHostLine(strings.TrimSpace(line))
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err == nil && bytes.Equal(hostKey.Marshal(), pubKey.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host access status codes, also used as check-host-access exit codes
+const (
+	accessOK            = 0 // Host can access secrets
+	accessNoSecrets     = 1 // No secrets file exists yet
+	accessNotInHosts    = 2 // Host key not in hosts file
+	accessCannotDecrypt = 3 // Host key cannot decrypt
+)
+
+// Names used for the status in check-host-access --json
+var accessStatusNames = map[int]string{
+	accessOK:            "ok",
+	accessNoSecrets:     "no_secrets",
+	accessNotInHosts:    "not_in_hosts",
+	accessCannotDecrypt: "cannot_decrypt",
+}
+
+var accessDescriptions = map[int]string{
+	accessOK:            "this host can decrypt the secrets",
+	accessNoSecrets:     "no secrets file exists yet",
+	accessNotInHosts:    "this host's key is not in the hosts file",
+	accessCannotDecrypt: "this host's key is in the hosts file but cannot decrypt",
+}
+
+// Check whether this host can decrypt, printing what to do about it if not
+func checkHostAccess() (int, error) {
+	if err := ensureSecretsID(); err != nil {
+		return 0, err
+	}
+
+	status, err := hostAccessStatus()
+	if err != nil {
+		return 0, err
+	}
+	printAccessHelp(status)
+	return status, nil
+}
+
+// Fail, after explaining why, unless this host can decrypt the secrets
+func requireAccess() error {
+	status, err := checkHostAccess()
+	if err != nil {
+		return err
+	}
+	if status != accessOK {
+		return exitCode(status)
+	}
+	return nil
+}
+
+// Work out the host access status without printing anything
+func hostAccessStatus() (int, error) {
+	// Check if neither secrets file nor hosts file exists
+	if !secretsFileExists() && !hostsExist(secretsHosts) {
+		return accessNoSecrets, nil
+	}
+
+	if !hostListedIn(secretsHosts) {
+		return accessNotInHosts, nil
+	}
+
+	// A listed host with nothing to decrypt yet can create the file
+	if !secretsFileExists() {
+		return accessNoSecrets, nil
+	}
+
+	// Check that this host can decrypt
+	identities, err := loadIdentities()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to load identity: %w", err)
+	}
+
+	start := time.Now()
+	content, err := secrets.DecryptFile(secretsFile, identities...)
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return 0, errors.New("Failed to open secrets file")
+	}
+	if err != nil {
+		debugf("decryption failed: %v", err)
+		return accessCannotDecrypt, nil
+	}
+	debugf("decrypted %s in %v", secretsFile, time.Since(start))
+	discardAccessPlaintext()
+	accessPlaintext = content
+
+	return accessOK, nil
+}
+
+// Whether there's a secrets file to decrypt. An empty one, such as a
+// placeholder committed before there were any secrets, counts as missing so
+// the first write can replace it.
+func secretsFileExists() bool {
+	info, err := os.Stat(secretsFile)
+	return err == nil && info.Size() > 0
+}
+
+// Whether this host's key (or an ssh-agent key, or the age identity file)
+// is in the hosts file at path
+func hostListedIn(path string) bool {
+	pubKey, err := readFile(secretsID + ".pub")
+	if err != nil {
+		debugf("no public key: %v", err)
+	}
+	hostsContent, err := readHosts(path)
+	return err == nil && (hostsContainKey(hostsContent, pubKey) || hostsContainAgentRecipient(hostsContent) || hostsContainAgeIdentity(hostsContent))
+}
+
+// Plaintext decrypted by the last access check, handed to the next
+// decryptToBytes so checking access and then reading the secrets decrypts
+// the file once (and asks a plugin or security key once)
+var accessPlaintext []byte
+
+// Zero and drop the access check's plaintext, once it's stale or unneeded
+func discardAccessPlaintext() {
+	zero(accessPlaintext)
+	accessPlaintext = nil
+}
+
+// Print the steps that get a host from the given status to having access
+func printAccessHelp(status int) {
+	switch status {
+	case accessNoSecrets:
+		if hostsExist(secretsHosts) {
+			fmt.Println(noteText("No secrets file exists yet.") + " This host is in the hosts file, so")
+			fmt.Println("'secrets edit' or 'secrets set' creates and encrypts the first secrets")
+			return
+		}
+		fmt.Println(noteText("No secrets file exists yet.") + " " + heading("To get started:"))
+		fmt.Println("1. Run 'secrets add-this-host' on this machine to create your first key")
+		fmt.Println("2. Run 'secrets edit' to create and encrypt your first secrets")
+	case accessNotInHosts:
+		fmt.Println(badText("This host is not authorized to access secrets."))
+		fmt.Println()
+		fmt.Println(heading("To authorize this host:"))
+		fmt.Println("1. Run 'secrets add-this-host' to add this host's key, or")
+		fmt.Println("   'secrets clone-access <host>' to give it the same access as another host")
+		printRevalidateSteps(2, "")
+	case accessCannotDecrypt:
+		fmt.Println(badText("This host's key is in the hosts file but cannot decrypt."))
+		fmt.Println()
+		fmt.Println(heading("To fix this:"))
+		printRevalidateSteps(1, "")
+		fmt.Println()
+		fmt.Println(heading("If you don't have access to a machine that can decrypt:"))
+		fmt.Println("Ask someone with access to run 'secrets revalidate' to authorize your key")
+	}
+}
+
+// Print the numbered steps, starting at step, that take a key already in
+// the hosts file to one the secrets are encrypted for. from names the
+// machine to revalidate on, if known.
+func printRevalidateSteps(step int, from string) {
+	if from == "" {
+		from = "a machine that can decrypt"
+	}
+	fmt.Printf("%d. Get the updated hosts file to %s (commit and push it, or use 'secrets sync')\n", step, from)
+	fmt.Printf("%d. Run 'secrets revalidate' on %s\n", step+1, from)
+	fmt.Printf("%d. Pull the reencrypted secrets here and run 'secrets check-host-access'\n", step+2)
+}
+
+// Decrypt the secrets file and return the plaintext in memory
+func decryptToBytes() ([]byte, error) {
+	decryptedContent, err := decryptOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files encrypted before CRLF was normalized on save may still have it
+	if bytes.Contains(decryptedContent, []byte("\r\n")) {
+		normalized := normalizeNewlines(decryptedContent)
+		zero(decryptedContent)
+		decryptedContent = normalized
+	}
+
+	return decryptedContent, nil
+}
+
+// Take the plaintext from the access check if there is one, or decrypt
+func decryptOnce() ([]byte, error) {
+	if accessPlaintext != nil {
+		debugf("reusing the plaintext from the access check")
+		content := accessPlaintext
+		accessPlaintext = nil
+		return content, nil
+	}
+
+	identities, err := loadIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	start := time.Now()
+	content, err := secrets.DecryptFile(secretsFile, identities...)
+	debugf("decrypted %s in %v", secretsFile, time.Since(start))
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		if accessErr := requireAccess(); accessErr != nil {
+			return nil, accessErr
+		}
+	}
+	if err != nil {
+		return nil, codedError{exitDecryptFailed, err}
+	}
+	return content, nil
+}
+
+func encryptSecrets(plaintext []byte) error {
+	hosts, err := encryptionHosts()
+	if err != nil {
+		return err
+	}
+	if err := confirmFewerRecipients(len(hosts)); err != nil {
+		return err
+	}
+	if err := confirmNewRecipients(hosts); err != nil {
+		return err
+	}
+	ageRecipients := recipientsOf(hosts)
+
+	if backup {
+		if err := backupSecrets(); err != nil {
+			return fmt.Errorf("failed to back up secrets file: %w", err)
+		}
+	}
+
+	// An armored file stays armored, so --armor only has to be given once
+	encrypt := secrets.EncryptFile
+	if armored, _ := secrets.IsArmored(secretsFile); armored || armorOutput {
+		debugf("writing %s ASCII-armored", secretsFile)
+		encrypt = secrets.EncryptFileArmored
+	}
+
+	start := time.Now()
+	if err := encrypt(secretsFile, plaintext, ageRecipients); err != nil {
+		return err
+	}
+	discardAccessPlaintext()
+	encryptedFiles = append(encryptedFiles, secretsFile)
+	debugf("encrypted %s to %d recipient(s) in %v", secretsFile, len(ageRecipients), time.Since(start))
+	return nil
+}
+
+// Ask before rewriting secrets.age for fewer recipients than it has now, so
+// a truncated hosts file or a stray --no-self can't take access away from
+// machines without anyone noticing
+func confirmFewerRecipients(count int) error {
+	stanzas, err := secrets.ReadStanzas(secretsFile)
+	if err != nil {
+		// No file yet, or one that can't be compared; nothing to lose
+		debugf("not comparing recipient counts: %v", err)
+		return nil
+	}
+	if count >= len(stanzas) {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: %s is encrypted to %d recipient(s) but would now be encrypted to only %d;\n", secretsFile, len(stanzas), count)
+	fmt.Fprintln(os.Stderr, "the others lose access ('secrets audit' shows which keys)")
+	if !confirm("Reencrypt for fewer recipients?") {
+		return errors.New("not reencrypting for fewer recipients (pass --yes if that's intended)")
+	}
+	return nil
+}
+
+// Ask about each host that would be granted access it doesn't have now,
+// whatever the command, so a key slipped into the hosts file isn't let in
+// unnoticed by the next write. This host's own key and hosts added in this
+// run aren't asked about. SSH keys are matched by their tag in the age
+// header; age1 and plugin recipients can only be counted, so if there are
+// more of them than the file has, each one is asked about.
+func confirmNewRecipients(hosts []secrets.Recipient) error {
+	stanzas, err := secrets.ReadStanzas(secretsFile)
+	if err != nil {
+		debugf("not comparing recipients: %v", err)
+		return nil
+	}
+	self := ""
+	if pubKeyBytes, err := readFile(secretsID + ".pub"); err == nil {
+		if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes); err == nil {
+			self = ssh.FingerprintSHA256(pubKey)
+		}
+	}
+
+	fileTags := make(map[string]bool)
+	fileAge := 0
+	for _, st := range stanzas {
+		if strings.HasPrefix(st.Type, "ssh-") && len(st.Args) > 0 {
+			fileTags[st.Args[0]] = true
+		} else {
+			fileAge++
+		}
+	}
+	var granted, ageHosts []secrets.Recipient
+	for _, h := range hosts {
+		if h.Tag == "" {
+			ageHosts = append(ageHosts, h)
+		} else if !fileTags[h.Tag] {
+			granted = append(granted, h)
+		}
+	}
+	if len(ageHosts) > fileAge {
+		fmt.Fprintf(os.Stderr, "The hosts file lists %d age recipient(s) but the file has %d, and they can't be told apart\n", len(ageHosts), fileAge)
+		granted = append(granted, ageHosts...)
+	}
+
+	for _, h := range granted {
+		if h.Fingerprint == self || approvedGrants[h.Fingerprint] {
+			continue
+		}
+		name := h.Comment
+		if name == "" {
+			name = "(unnamed)"
+		}
+		if !confirm(fmt.Sprintf("Grant access to %s (%s)?", name, h.Fingerprint)) {
+			return fmt.Errorf("access for %s (%s) was not confirmed (remove it from the hosts file, or pass --yes)", name, h.Fingerprint)
+		}
+	}
+	return nil
+}
+
+// The recipients encryptSecrets uses, as age recipients
+func encryptionRecipients() ([]age.Recipient, error) {
+	hosts, err := encryptionHosts()
+	if err != nil {
+		return nil, err
+	}
+	return recipientsOf(hosts), nil
+}
+
+func recipientsOf(hosts []secrets.Recipient) []age.Recipient {
+	ageRecipients := make([]age.Recipient, len(hosts))
+	for i, h := range hosts {
+		ageRecipients[i] = h.Recipient
+	}
+	return ageRecipients
+}
+
+// Keep the recipients in any of groups, whether a host joins a group with
+// "group:" in its hosts file description or by being listed under the group
+// in secrets.yaml. A secrets.yaml group naming a host that isn't in the
+// hosts file is an error, since it's most likely a typo.
+func filterGroups(recipients []secrets.Recipient, groups []string, path string) ([]secrets.Recipient, error) {
+	rules, err := loadRules(secretsPath)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool)
+	if rules != nil {
+		members = rules.members(groups)
+	}
+	wanted := make(map[string]bool)
+	for _, group := range groups {
+		wanted[group] = true
+	}
+
+	var selected []secrets.Recipient
+	found := make(map[string]bool)
+	for _, r := range recipients {
+		inGroup := members[r.Comment]
+		for _, group := range r.Groups {
+			inGroup = inGroup || wanted[group]
+		}
+		if inGroup {
+			selected = append(selected, r)
+			found[r.Comment] = true
+		}
+	}
+	var missing []string
+	for name := range members {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("group(s) %s list host(s) not in %s: %s", strings.Join(groups, ", "), path, strings.Join(missing, ", "))
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no hosts in group(s) %s", strings.Join(groups, ", "))
+	}
+	debugf("%d recipient(s) in group(s) %s", len(selected), strings.Join(groups, ", "))
+	return selected, nil
+}
+
+// Every host in the hosts file (or --recipients-file) plus this host's own
+// key, so whoever encrypts can always decrypt again. --no-self leaves out
+// the own key when the hosts file doesn't list it. Every path that encrypts
+// comes through here, so this is where an unsigned hosts file is refused.
+func encryptionHosts() ([]secrets.Recipient, error) {
+	if err := requireSignedHosts(); err != nil {
+		return nil, err
+	}
+	path, groups := encryptionHostsPath(), fileGroups
+	if recipientsFile != "" {
+		groups = nil
+	}
+	debugf("encrypting to hosts in %s", path)
+	recipients, err := loadSSHRecipients(path, groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recipients: %w", err)
+	}
+
+	// This host alone is never enough: the hosts file must name someone, or
+	// an emptied or unparseable hosts file would quietly lock out every
+	// other machine
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no valid recipients found in %s, refusing to encrypt", path)
+	}
+	if noSelf {
+		debugf("--no-self: encrypting to the hosts file only")
+		return sortedRecipients(recipients), nil
+	}
+
+	// Also add current identity as recipient
+	_, err = loadSSHIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH identity: %w", err)
+	}
+
+	// Read current public key to add as recipient
+	pubKeyBytes, err := readFile(secretsID + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	pubKey, comment, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	selfRecipient, err := secrets.NewSSHRecipient(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recipient from own key: %w", err)
+	}
+
+	// Check if self is already in recipients
+	selfFingerprint := ssh.FingerprintSHA256(pubKey)
+	selfInRecipients := false
+	for _, r := range recipients {
+		if r.Fingerprint == selfFingerprint {
+			selfInRecipients = true
+			break
+		}
+	}
+	if !selfInRecipients {
+		fmt.Fprintf(os.Stderr, "Warning: this host's key (%s) is not in the hosts file but is being given access anyway\n", selfFingerprint)
+		fmt.Fprintln(os.Stderr, "Run 'secrets add-this-host' to list it, or pass --no-self to encrypt to the hosts file only")
+		recipients = append(recipients, secrets.Recipient{
+			Recipient:   selfRecipient,
+			Fingerprint: selfFingerprint,
+			Comment:     comment,
+			Description: "this host, not in the hosts file",
+			Tag:         secrets.SSHTag(pubKey),
+		})
+	}
+
+	return sortedRecipients(recipients), nil
+}
+
+// The hosts file encryptSecrets reads: --recipients-file, or secretsHosts
+func encryptionHostsPath() string {
+	if recipientsFile != "" {
+		return recipientsFile
+	}
+	return secretsHosts
+}
+
+// Show who encryptSecrets would encrypt to, for --dry-run
+func printEncryptionHosts() error {
+	recipients, err := encryptionHosts()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Would encrypt to %d recipient(s):\n", len(recipients))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range recipients {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", r.Comment, r.Fingerprint, r.Description)
+	}
+	w.Flush()
+	return nil
+}
+
+// Copy the current secrets file to secrets.age.bak.<timestamp> and prune
+// all but the newest SECRETS_BACKUPS (default 5) backups
+func backupSecrets() error {
+	keep := defaultBackups
+	if v := os.Getenv("SECRETS_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("SECRETS_BACKUPS must be a positive number, got %q", v)
+		}
+		keep = n
+	}
+
+	current, err := readFile(secretsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	backupPath := secretsFile + ".bak." + time.Now().Format("20060102T150405")
+	if err := os.WriteFile(backupPath, current, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %s to %s\n", filepath.Base(secretsFile), filepath.Base(backupPath))
+
+	// Timestamps sort lexically, so the oldest backups come first
+	backups, err := filepath.Glob(secretsFile + ".bak.*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func cmdList(args []string) error {
+	fs := newFlagSet("list")
+	jsonOutput := fs.Bool("json", false, "Output secrets as a JSON object")
+	yamlOutput := fs.Bool("yaml", false, "Output secrets as a YAML mapping")
+	keysOnly := fs.Bool("keys", false, "Output only key names")
+	count := fs.Bool("count", false, "Output only the number of keys")
+	only := fs.String("only", "", "Comma-separated keys to include")
+	except := fs.String("except", "", "Comma-separated keys to exclude")
+	section := fs.String("section", "", "Only include keys under this [section]")
+	parseArgs(fs, args)
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	vars, err := filterSection(parseEnv(content), *section)
+	if err != nil {
+		return err
+	}
+	vars, err = filterEnv(vars, *only, *except)
+	if err != nil {
+		return err
+	}
+
+	// Counts what activate would export, so duplicates count once
+	if *count {
+		seen := make(map[string]bool)
+		for _, v := range vars {
+			seen[v.key] = true
+		}
+		fmt.Println(len(seen))
+		return nil
+	}
+
+	if *keysOnly {
+		for _, v := range vars {
+			fmt.Println(v.key)
+		}
+		return nil
+	}
+
+	if *jsonOutput || *yamlOutput {
+		env := make(map[string]string)
+		for _, v := range vars {
+			env[v.key] = v.value
+			if mask {
+				env[v.key] = maskValue(v.value)
+			}
+		}
+		if *yamlOutput {
+			// Values that would read back as numbers or booleans are quoted
+			out, err := yaml.Marshal(env)
+			if err != nil {
+				return fmt.Errorf("Failed to encode YAML: %w", err)
+			}
+			fmt.Print(string(out))
+			return nil
+		}
+		out, err := json.MarshalIndent(env, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Failed to encode JSON: %w", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	// A filtered listing only has the selected keys, so comments are dropped
+	if *only != "" || *except != "" || *section != "" {
+		var b strings.Builder
+		for _, v := range vars {
+			b.WriteString(secrets.FormatEnvLine(v.key, v.value) + "\n")
+		}
+		content = []byte(b.String())
+	}
+
+	if mask {
+		content = maskEnv(content)
+	}
+	fmt.Print(string(content))
+	return nil
+}
+
+func cmdActivate(args []string) error {
+	fs := newFlagSet("activate")
+	prefix := fs.String("prefix", "", "Prepend a prefix to every variable name (e.g. PROJECT_)")
+	only := fs.String("only", "", "Comma-separated keys to include")
+	except := fs.String("except", "", "Comma-separated keys to exclude")
+	section := fs.String("section", "", "Only include keys under this [section]")
+	watch := fs.Bool("watch", false, "Keep running, printing commands for changed keys whenever the secrets file changes")
+	args = parseArgs(fs, args)
+	if len(args) < 1 {
+		return errors.New("Usage: secrets activate [--prefix PREFIX] [--only KEYS] [--except KEYS] [--section NAME] [--watch] <shell>\nSupported shells: fish, bash, zsh, sh, powershell, github, docker")
+	}
+	shell := args[0]
+	if *watch && (shell == "github" || shell == "docker") {
+		return fmt.Errorf("--watch needs a shell to apply its updates, not %s", shell)
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	// --watch applies the same selection to every version of the file
+	selectVars := func(content []byte) ([]envVar, error) {
+		vars, err := filterSection(parseEnv(content), *section)
+		if err != nil {
+			return nil, err
+		}
+		vars, err = filterEnv(vars, *only, *except)
+		if err != nil {
+			return nil, err
+		}
+		ignored, err := loadActivateIgnore(secretsPath)
+		if err != nil {
+			return nil, err
+		}
+		vars = filterIgnored(vars, ignored, *only)
+		if *prefix != "" {
+			// Check every name before printing anything that might get eval'd
+			for i := range vars {
+				vars[i].key = *prefix + vars[i].key
+				if !validKey.MatchString(vars[i].key) {
+					return nil, fmt.Errorf("Prefixed name %q is not a valid variable name", vars[i].key)
+				}
+			}
+		}
+		return vars, nil
+	}
+	vars, err := selectVars(content)
+	if err != nil {
+		return err
+	}
+
+	if shell == "github" {
+		return activateGitHub(vars)
+	}
+	if shell == "docker" {
+		// --env-file takes each line literally, so there's no way to
+		// escape a line break
+		for _, v := range vars {
+			if strings.ContainsAny(v.value, "\r\n") {
+				return fmt.Errorf("%s has a multiline value, which docker --env-file can't express", v.key)
+			}
+		}
+	}
+
+	if err := printActivate(shell, vars); err != nil {
+		return err
+	}
+	if *watch {
+		return watchActivate(shell, vars, selectVars)
+	}
+	return nil
+}
+
+// Print the commands setting vars in shell
+func printActivate(shell string, vars []envVar) error {
+	for _, v := range vars {
+		switch shell {
+		case "fish":
+			// Fish format - set -gx
+			fmt.Printf("set -gx %s %s\n", v.key, quoteFish(v.value))
+		case "bash", "zsh", "sh":
+			// Bash/Zsh/sh format - export
+			fmt.Printf("export %s=%s\n", v.key, quotePosix(v.value))
+		case "powershell", "pwsh":
+			// PowerShell format - $env:KEY = 'value'
+			fmt.Printf("$env:%s = %s\n", v.key, quotePowerShell(v.value))
+		case "docker":
+			// docker --env-file format - bare KEY=value, never quoted
+			fmt.Printf("%s=%s\n", v.key, v.value)
+		default:
+			return fmt.Errorf("Unsupported shell: %s. Supported shells: fish, bash, zsh, sh, powershell, github, docker", shell)
+		}
+	}
+	return nil
+}
+
+// Append vars to the file GitHub Actions names in $GITHUB_ENV, which sets
+// them for the following steps, or print them when it isn't set
+func activateGitHub(vars []envVar) error {
+	var out bytes.Buffer
+	defer func() { zero(out.Bytes()) }()
+	for _, v := range vars {
+		line, err := githubEnvLine(v.key, v.value)
+		if err != nil {
+			return err
+		}
+		out.WriteString(line)
+	}
+
+	path := os.Getenv("GITHUB_ENV")
+	if path == "" {
+		os.Stdout.Write(out.Bytes())
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open $GITHUB_ENV: %v", err)
+	}
+	if _, err := f.Write(out.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to write $GITHUB_ENV: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Failed to write $GITHUB_ENV: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Added %d variable(s) to $GITHUB_ENV\n", len(vars))
+	return nil
+}
+
+func cmdGet(args []string) error {
+	fs := newFlagSet("get")
+	section := fs.String("section", "", "Only look the key up under this [section]")
+	decodeBase64 := fs.Bool("decode-base64", false, "Print the base64-decoded value as raw bytes")
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets get [--section NAME] [--decode-base64] KEY")
+	}
+	key := args[0]
+	if *decodeBase64 && mask {
+		return errors.New("--decode-base64 and --mask can't be used together")
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	vars, err := filterSection(parseEnv(content), *section)
+	if err != nil {
+		return err
+	}
+
+	// The last definition wins, as it does when activated
+	value, found := "", false
+	for _, v := range vars {
+		if v.key == key {
+			value, found = v.value, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Key '%s' not found", key)
+	}
+
+	// Binary values are written as they are, without a trailing newline
+	if *decodeBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("Value of '%s' is not valid base64: %w", key, err)
+		}
+		defer zero(decoded)
+		_, err = os.Stdout.Write(decoded)
+		return err
+	}
+
+	if mask {
+		value = maskValue(value)
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func cmdGrep(args []string) error {
+	fs := newFlagSet("grep")
+	fixed := fs.Bool("fixed", false, "Match the pattern as a literal substring")
+	showValues := fs.Bool("show-values", false, "Print matching keys with their masked values")
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets grep [--fixed] [--show-values] <pattern>")
+	}
+
+	pattern := args[0]
+	if *fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid pattern: %w", err)
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	matched := false
+	for _, v := range parseEnv(content) {
+		if !re.MatchString(v.key) {
+			continue
+		}
+		matched = true
+		if *showValues {
+			fmt.Printf("%s=%s\n", v.key, maskValue(v.value))
+		} else {
+			fmt.Println(v.key)
+		}
+	}
+
+	// Like grep, no match is exit status 1
+	if !matched {
+		return exitCode(1)
+	}
+	return nil
+}
+
+// The path of the editor named, or else of $EDITOR, or else of nano
+func findEditor(name string) (string, error) {
+	if name == "" {
+		name = os.Getenv("EDITOR")
+	}
+	if name == "" {
+		name = "nano"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("Editor '%s' not found. Set $EDITOR or pass --editor", name)
+	}
+	return path, nil
+}
+
+func cmdEdit(args []string) error {
+	fs := newFlagSet("edit")
+	showDiff := fs.Bool("diff", false, "Show changed keys and confirm before encrypting")
+	showValues := fs.Bool("show-values", false, "Show values in the --diff output instead of masking them")
+	editor := fs.String("editor", "", "Editor to use (default $EDITOR, then nano)")
+	dedup := fs.Bool("dedup", false, "Keep only the last definition of duplicated keys")
+	fifo := fs.Bool("fifo", false, "Give the editor a named pipe instead of a temp file (not all editors cope)")
+	dryRun := fs.Bool("dry-run", false, "Validate the edit and show the recipients, but don't save it")
+	parseArgs(fs, args)
+
+	// Resolve the editor before decrypting so we never write plaintext to
+	// disk when it can't be edited
+	editorPath, err := findEditor(*editor)
+	if err != nil {
+		return err
+	}
+
+	// One decrypt both proves access and yields the content, which stays in
+	// memory and only touches the filesystem while the editor has it open
+	original, err := loadSecretsForUpdate()
+	if err != nil {
+		return err
+	}
+	if original == nil {
+		// Special case for first-time setup
+		fmt.Println("Creating new secrets file...")
+		original = []byte("EXAMPLE_API_KEY=change_me\n")
+	}
+
+	edit := editViaTempFile
+	if *fifo {
+		edit = editViaFIFO
+	}
+	defer zero(original)
+	content, err := edit(editorPath, original)
+	if err != nil {
+		return err
+	}
+	defer zero(content)
+
+	if bytes.Equal(content, original) {
+		fmt.Println("No changes made")
+		return nil
+	}
+
+	// Validate file format
+	content = normalizeNewlines(content)
+	if *dedup {
+		content = dedupEnv(content)
+	}
+	if _, err := validateEnv(content); err != nil {
+		return codedError{exitInvalid, err}
+	}
+
+	if *showDiff {
+		changes := diffEnv(original, content, *showValues)
+		if len(changes) == 0 {
+			fmt.Println("Only comments or formatting changed")
+		} else {
+			fmt.Println("Pending changes:")
+			for _, change := range changes {
+				fmt.Println("  " + change)
+			}
+		}
+		fmt.Println()
+		if !confirm("Encrypt these changes?") {
+			fmt.Println("Operation cancelled, secrets left unchanged")
+			return exitCode(1)
+		}
+	}
+
+	if *dryRun {
+		if err := printEncryptionHosts(); err != nil {
+			return err
+		}
+		fmt.Println("Dry run, secrets left unchanged")
+		return nil
+	}
+
+	// Encrypt the file
+	if err := encryptSecrets(content); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+
+	fmt.Println("Secrets updated successfully. Run the following to add to your shell:")
+	fmt.Println("  secrets activate fish | source  # for fish shell")
+	fmt.Println("  eval \"$(secrets activate bash)\"  # for bash shell")
+	fmt.Println("  eval \"$(secrets activate zsh)\"   # for zsh shell")
+	fmt.Println("  secrets activate pwsh | Out-String | Invoke-Expression  # for PowerShell")
+	return nil
+}
+
+// Lint the secrets file with the same rules edit applies before encrypting
+func cmdCheck(args []string) error {
+	parseArgs(newFlagSet("check"), args)
+
+	if !secretsFileExists() {
+		return errors.New("No secrets file at " + secretsFile)
+	}
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	keys, err := validateEnv(content)
+	if err != nil {
+		return codedError{exitInvalid, err}
+	}
+	fmt.Printf("%s is valid (%d keys)\n", secretsFile, len(keys))
+	return nil
+}
+
+// Compare the recipients secrets.age was encrypted to with the hosts file,
+// catching a forgotten revalidate after hosts were added or removed
+func cmdAudit(args []string) error {
+	parseArgs(newFlagSet("audit"), args)
+
+	if !secretsFileExists() {
+		return errors.New("No secrets file at " + secretsFile)
+	}
+	stanzas, err := secrets.ReadStanzas(secretsFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read secrets file: %w", err)
+	}
+	hosts, err := loadSSHRecipients(secretsHosts, fileGroups)
+	if err != nil {
+		return fmt.Errorf("Failed to load hosts: %w", err)
+	}
+
+	fmt.Printf("%d recipients in file, %d in hosts\n", len(stanzas), len(hosts))
+
+	// SSH stanzas name their key by tag so they can be matched one by one;
+	// other stanzas (age1 recipients, ssh-agent and plugin keys) can only be
+	// counted
+	hostTags := make(map[string]bool)
+	ageHosts := 0
+	for _, h := range hosts {
+		if h.Tag == "" {
+			ageHosts++
+		}
+		hostTags[h.Tag] = true
+	}
+	fileTags := make(map[string]bool)
+	var unknown []string
+	fileAge := 0
+	for _, st := range stanzas {
+		switch {
+		case st.Type == "X25519":
+			fileAge++
+		case strings.HasPrefix(st.Type, "ssh-") && len(st.Args) > 0:
+			fileTags[st.Args[0]] = true
+			if !hostTags[st.Args[0]] {
+				unknown = append(unknown, st.Type+" key "+st.Args[0])
+			}
+		default:
+			// age plugins (e.g. piv-p256 for age-plugin-yubikey) have their
+			// own stanza types and, like X25519, can only be counted
+			fileAge++
+		}
+	}
+	var missing []string
+	for _, h := range hosts {
+		if h.Tag != "" && !fileTags[h.Tag] {
+			missing = append(missing, h.Comment+" ("+h.Fingerprint+")")
+		}
+	}
+
+	drift := false
+	if len(unknown) > 0 {
+		drift = true
+		fmt.Printf("\n%d recipient(s) in the file are not in the hosts file and can still decrypt:\n", len(unknown))
+		for _, u := range unknown {
+			fmt.Println("  " + u)
+		}
+	}
+	if len(missing) > 0 {
+		drift = true
+		fmt.Printf("\n%d host(s) in the hosts file cannot decrypt yet:\n", len(missing))
+		for _, m := range missing {
+			fmt.Println("  " + m)
+		}
+	}
+	if fileAge != ageHosts {
+		drift = true
+		fmt.Printf("\nThe file has %d age recipient(s) but the hosts file lists %d\n", fileAge, ageHosts)
+	}
+
+	if drift {
+		fmt.Println()
+		fmt.Println("Run 'secrets revalidate' on a machine that can decrypt to encrypt for exactly the current hosts")
+		return exitCode(1)
+	}
+	fmt.Println("The secrets file matches the hosts file")
+	return nil
+}
+
+// List who an age file is encrypted to, from its header alone, so nothing
+// is decrypted. SSH stanzas carry only a 4-byte tag of the key, so they're
+// named by matching it against the hosts file and this host's own key; age1
+// and plugin stanzas don't identify their recipient at all.
+func cmdInspect(args []string) error {
+	args = parseArgs(newFlagSet("inspect"), args)
+	if len(args) > 1 {
+		return errors.New("Usage: secrets inspect [file.age]")
+	}
+	path := secretsFile
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	stanzas, err := secrets.ReadStanzas(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", path, err)
+	}
+
+	known := make(map[string]secrets.Recipient)
+	if hostsExist(secretsHosts) {
+		hosts, err := loadSSHRecipients(secretsHosts, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to load hosts: %w", err)
+		}
+		for _, h := range hosts {
+			if h.Tag != "" {
+				known[h.Tag] = h
+			}
+		}
+	}
+	selfTag := ""
+	if key, err := readPublicKey(); err == nil {
+		if pubKey, comment, _, _, err := ssh.ParseAuthorizedKey(key); err == nil {
+			selfTag = secrets.SSHTag(pubKey)
+			if _, ok := known[selfTag]; !ok {
+				known[selfTag] = secrets.Recipient{Comment: comment, Fingerprint: ssh.FingerprintSHA256(pubKey)}
+			}
+		}
+	}
+
+	fmt.Printf("%s is encrypted to %d recipient(s):\n", path, len(stanzas))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TYPE\tTAG\tHOST\tFINGERPRINT")
+	for _, st := range stanzas {
+		switch {
+		case strings.HasPrefix(st.Type, "ssh-") && len(st.Args) > 0:
+			tag := st.Args[0]
+			h, ok := known[tag]
+			if !ok {
+				fmt.Fprintf(w, "  %s\t%s\t(not in the hosts file)\t\n", st.Type, tag)
+				continue
+			}
+			name := h.Comment
+			if tag == selfTag {
+				name += " (this host)"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", st.Type, tag, name, h.Fingerprint)
+		case st.Type == "X25519":
+			fmt.Fprintf(w, "  %s\t\t(an age1 recipient, not identifiable)\t\n", st.Type)
+		case st.Type == "scrypt":
+			fmt.Fprintf(w, "  %s\t\t(passphrase)\t\n", st.Type)
+		default:
+			fmt.Fprintf(w, "  %s\t\t(an age plugin recipient, not identifiable)\t\n", st.Type)
+		}
+	}
+	w.Flush()
+	return nil
+}
+
+// Decrypt the current secrets for a command that rewrites them. A missing
+// or empty secrets file is treated as empty so the first write creates it.
+func loadSecretsForUpdate() ([]byte, error) {
+	if !secretsFileExists() {
+		return nil, checkFirstWrite()
+	}
+
+	if err := requireAccess(); err != nil {
+		return nil, err
+	}
+	content, err := decryptToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	return content, nil
+}
+
+// Check that this host can create the first secrets file, printing what to
+// do first if not. Whatever is written has to be encrypted to a hosts file
+// that lists this host (the one --recipients-file names, if given), or the
+// host couldn't read back its own secrets.
+func checkFirstWrite() error {
+	if err := ensureSecretsID(); err != nil {
+		return err
+	}
+	path := encryptionHostsPath()
+	if !hostsExist(path) {
+		if recipientsFile != "" {
+			return fmt.Errorf("Failed to read %s: no such file", path)
+		}
+		printAccessHelp(accessNoSecrets)
+		return exitCode(accessNoSecrets)
+	}
+	if hostListedIn(path) {
+		return nil
+	}
+
+	// With no secrets yet there is nothing to revalidate, so once listed
+	// this host can go straight on
+	fmt.Println(badText("This host is not in " + path + ", so it couldn't read the secrets it creates."))
+	fmt.Println()
+	fmt.Println(heading("To authorize this host:"))
+	fmt.Println("1. Run 'secrets add-this-host' to add this host's key, or")
+	fmt.Println("   'secrets clone-access <host>' to give it the same access as another host")
+	fmt.Println("2. Run this command again to create the secrets file")
+	return exitCode(accessNotInHosts)
+}
+
+func cmdSet(args []string) error {
+	fs := newFlagSet("set")
+	prompt := fs.Bool("prompt", false, "Read the value of KEY from the terminal without echo")
+	encodeBase64 := fs.Bool("encode-base64", false, "With KEY -, store the raw bytes from stdin base64-encoded")
+	args = parseArgs(fs, args)
+	usage := "Usage: secrets set KEY=value [KEY=value...]\n       secrets set [--encode-base64] KEY -        (value from stdin)\n       secrets set --prompt KEY"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	if *encodeBase64 && (*prompt || len(args) != 2 || args[1] != "-") {
+		return errors.New("--encode-base64 only applies to 'secrets set KEY -'")
+	}
+
+	// Values read from stdin or the terminal never appear in argv, so they
+	// stay out of shell history and ps
+	var assignments []string
+	switch {
+	case *prompt:
+		if len(args) != 1 || strings.Contains(args[0], "=") {
+			return errors.New(usage)
+		}
+		value, err := readSecretValue("Value for " + args[0] + ": ")
+		if err != nil {
+			return fmt.Errorf("Failed to read value: %w", err)
+		}
+		assignments = []string{args[0] + "=" + value}
+	case len(args) == 2 && args[1] == "-" && !strings.Contains(args[0], "="):
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Failed to read value from stdin: %w", err)
+		}
+		if *encodeBase64 {
+			assignments = []string{args[0] + "=" + base64.StdEncoding.EncodeToString(value)}
+			zero(value)
+			break
+		}
+		// Multiline values like PEM keys are stored as heredoc blocks; only
+		// the final newline that ends the input is dropped
+		normalized := normalizeNewlines(value)
+		zero(value)
+		assignments = []string{args[0] + "=" + string(bytes.TrimSuffix(normalized, []byte("\n")))}
+		zero(normalized)
+	default:
+		assignments = args
+	}
+
+	// Check every assignment before decrypting anything
+	for _, arg := range assignments {
+		key, _, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("Invalid assignment '%s', expected KEY=value", arg)
+		}
+		if !allowAnyKey && !validKey.MatchString(key) {
+			return fmt.Errorf("Invalid key name %q: keys must match %s (use --allow-any-key to override)", key, validKey)
+		}
+	}
+
+	content, err := loadSecretsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer zero(content)
+	lines := parseEnvLines(content)
+	var results []string
+	for _, arg := range assignments {
+		key, value, _ := strings.Cut(arg, "=")
+		var existed bool
+		lines, existed = setEnvValue(lines, key, value)
+		if existed {
+			results = append(results, "Updated "+key)
+		} else {
+			results = append(results, "Added "+key)
+		}
+	}
+
+	updated := formatEnvLines(lines)
+	defer zero(updated)
+	if err := encryptSecrets(updated); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+	fmt.Println(strings.Join(results, "\n"))
+	return nil
+}
+
+func cmdUnset(args []string) error {
+	args = parseArgs(newFlagSet("unset"), args)
+	if len(args) == 0 {
+		return errors.New("Usage: secrets unset KEY [KEY...]")
+	}
+
+	content, err := loadSecretsForUpdate()
+	if err != nil {
+		return err
+	}
+	defer zero(content)
+
+	// Fail on any unknown key so a typo doesn't silently do nothing
+	lines := parseEnvLines(content)
+	for _, key := range args {
+		var existed bool
+		if lines, existed = unsetEnvKey(lines, key); !existed {
+			return fmt.Errorf("Key '%s' not found, nothing was changed", key)
+		}
+	}
+
+	updated := formatEnvLines(lines)
+	defer zero(updated)
+	if err := encryptSecrets(updated); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+	fmt.Printf("Removed %s\n", strings.Join(args, ", "))
+	return nil
+}
+
+func cmdImport(args []string) error {
+	fs := newFlagSet("import")
+	replace := fs.Bool("replace", false, "Discard current secrets instead of merging")
+	dedup := fs.Bool("dedup", false, "Keep only the last definition of duplicated keys")
+	appendKeys := fs.Bool("append", false, "Add keys to the current secrets, failing on conflicting values")
+	overwrite := fs.Bool("overwrite", false, "With --append, take the imported value of conflicting keys")
+	keep := fs.Bool("keep", false, "With --append, keep the current value of conflicting keys")
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets import [--replace | --append [--overwrite | --keep]] [--dedup] <file>")
+	}
+	if *replace && *appendKeys {
+		return errors.New("--replace and --append can't be used together")
+	}
+	if (*overwrite || *keep) && !*appendKeys {
+		return errors.New("--overwrite and --keep only apply with --append")
+	}
+	if *overwrite && *keep {
+		return errors.New("--overwrite and --keep can't be used together")
+	}
+
+	// Validate the whole file up front so an import is all or nothing
+	imported, err := readFile(args[0])
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", args[0], err)
+	}
+	imported = normalizeNewlines(imported)
+	if *dedup {
+		imported = dedupEnv(imported)
+	}
+	if _, err := validateEnv(imported); err != nil {
+		return codedError{exitInvalid, fmt.Errorf("Import rejected, nothing was changed: %w", err)}
+	}
+
+	// --replace discards the current secrets, but only a host that could
+	// read them may replace them
+	var current []byte
+	if *replace && secretsFileExists() {
+		if err := requireAccess(); err != nil {
+			return err
+		}
+	} else if *replace {
+		if err := checkFirstWrite(); err != nil {
+			return err
+		}
+	} else {
+		if current, err = loadSecretsForUpdate(); err != nil {
+			return err
+		}
+		defer zero(current)
+	}
+
+	content, added, updated, skipped := imported, 0, 0, 0
+	switch {
+	case *appendKeys:
+		if conflicts := envConflicts(current, imported); len(conflicts) > 0 && !*overwrite && !*keep {
+			return fmt.Errorf("Import rejected, nothing was changed: %s already set to a different value\n"+
+				"Use --overwrite to take the imported values or --keep to keep the current ones",
+				strings.Join(conflicts, ", "))
+		}
+		content, added, updated, skipped = appendEnv(current, imported, *keep)
+	case !*replace:
+		content, added, updated = mergeEnv(current, imported)
+	}
+
+	if err := encryptSecrets(content); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+
+	if *appendKeys {
+		fmt.Printf("Appended %s: %d key(s) added, %d overwritten, %d skipped\n", args[0], added, updated, skipped)
+	} else if *replace {
+		fmt.Printf("Replaced secrets with %d key(s) from %s\n", len(parseEnv(imported)), args[0])
+	} else {
+		fmt.Printf("Imported %s: %d key(s) added, %d overwritten\n", args[0], added, updated)
+	}
+	return nil
+}
+
+func cmdExport(args []string) error {
+	args = parseArgs(newFlagSet("export"), args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets export <file|->")
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	if args[0] == "-" {
+		os.Stdout.Write(content)
+		return nil
+	}
+
+	// writeFile only applies 0600 when creating the file, so tighten an
+	// existing file before any plaintext goes into it
+	if err := os.Chmod(args[0], 0600); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to set permissions on %s: %v", args[0], err)
+	}
+	if err := writeFile(args[0], content); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", args[0], err)
+	}
+	fmt.Fprintf(os.Stderr, "Secrets written to %s\n", args[0])
+	return nil
+}
+
+// Decrypt an age file on stdin to stdout with this host's identities,
+// leaving the managed secrets file alone. --passphrase decrypts a file made
+// by encrypt --passphrase instead, without touching any keys.
+func cmdDecrypt(args []string) error {
+	fs := newFlagSet("decrypt")
+	passphrase := fs.Bool("passphrase", false, "Decrypt with a passphrase instead of this host's keys")
+	if len(parseArgs(fs, args)) != 0 {
+		return errors.New("Usage: secrets decrypt [--passphrase] < file.age")
+	}
+
+	var identities []age.Identity
+	if *passphrase {
+		pass, err := promptPassphrase(false)
+		if err != nil {
+			return fmt.Errorf("Failed to read passphrase: %w", err)
+		}
+		identity, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt: %w", err)
+		}
+		identities = []age.Identity{identity}
+	} else {
+		var err error
+		identities, err = loadIdentities()
+		if err != nil {
+			return fmt.Errorf("Failed to load identity: %w", err)
+		}
+	}
+
+	r, err := secrets.DecryptReader(os.Stdin, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		if *passphrase {
+			return codedError{exitDecryptFailed, errors.New("Wrong passphrase, or the input wasn't encrypted with one")}
+		}
+		return codedError{exitDecryptFailed, errors.New("This host's keys can't decrypt the input")}
+	}
+	if err != nil {
+		return codedError{exitDecryptFailed, fmt.Errorf("Failed to decrypt: %w", err)}
+	}
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	return nil
+}
+
+// Encrypt stdin to stdout for the same recipients as the secrets file.
+// --passphrase encrypts to a typed passphrase instead, for machines with no
+// key in the hosts file; it is never used unless asked for.
+func cmdEncrypt(args []string) error {
+	fs := newFlagSet("encrypt")
+	passphrase := fs.Bool("passphrase", false, "Encrypt with a passphrase instead of the hosts file")
+	if len(parseArgs(fs, args)) != 0 {
+		return errors.New("Usage: secrets encrypt [--passphrase] < file > file.age")
+	}
+	if !armorOutput && term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("Refusing to write encrypted data to a terminal; redirect stdout or use --armor")
+	}
+
+	var recipients []age.Recipient
+	if *passphrase {
+		pass, err := promptPassphrase(true)
+		if err != nil {
+			return fmt.Errorf("Failed to read passphrase: %w", err)
+		}
+		recipient, err := age.NewScryptRecipient(pass)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt: %w", err)
+		}
+		recipients = []age.Recipient{recipient}
+	} else {
+		var err error
+		recipients, err = encryptionRecipients()
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt: %w", err)
+		}
+	}
+
+	w, err := secrets.EncryptWriter(os.Stdout, recipients, armorOutput)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+	if _, err := io.Copy(w, os.Stdin); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to encrypt: %w", err)
+	}
+	return nil
+}
+
+func cmdRevalidate(args []string) error {
+	fs := newFlagSet("revalidate")
+	dryRun := fs.Bool("dry-run", false, "Show the recipients without reencrypting")
+	group := fs.String("group", "", "Only encrypt to hosts in these comma-separated groups")
+	force := fs.Bool("force", false, "Reencrypt even if the decrypted secrets are empty or invalid")
+	parseArgs(fs, args)
+
+	if *group != "" {
+		fileGroups = splitKeyList(*group)
+	}
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if err := printEncryptionHosts(); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Revalidate only changes the recipients, so whatever comes out of
+	// decryption goes back in as is
+	if err := reencryptCurrent(*force); err != nil {
+		return err
+	}
+
+	fmt.Println("Revalidation successful!")
+	if *group != "" {
+		fmt.Printf("File has been re-encrypted for group(s) %s only\n", strings.Join(fileGroups, ", "))
+		return nil
+	}
+	fmt.Println("File has been re-encrypted with all current host keys")
+	return nil
+}
+
+// After the hosts file changes, reencrypt straight away if this host can
+// already decrypt; otherwise a host that can has to run revalidate. With no
+// secrets yet there's nothing to reencrypt, and the first write encrypts to
+// the new key anyway.
+func revalidateAfterAdd(from string) error {
+	if !secretsFileExists() {
+		fmt.Println()
+		fmt.Println(noteText("No secrets file exists yet.") + " The first 'secrets edit' or 'secrets set'")
+		fmt.Println("creates it, encrypted to every host in the hosts file")
+		return nil
+	}
+	if status, err := hostAccessStatus(); err != nil {
+		return err
+	} else if status == accessOK {
+		return revalidateLocally()
+	}
+	fmt.Println()
+	fmt.Println(heading("The key still has to be authorized:"))
+	printRevalidateSteps(1, from)
+	return nil
+}
+
+func revalidateLocally() error {
+	// The changed hosts file needs a fresh signature before anyone reencrypts
+	if err := requireSignedHosts(); err != nil {
+		fmt.Println()
+		fmt.Println(noteText("Not reencrypting: " + err.Error()))
+		fmt.Println(heading("To authorize the key:"))
+		fmt.Println("1. Run 'secrets hosts sign' on a machine with a trusted signing key")
+		fmt.Println("2. Run 'secrets revalidate'")
+		return nil
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+	if err := encryptSecrets(content); err != nil {
+		return fmt.Errorf("Failed to reencrypt: %w", err)
+	}
+	fmt.Println("This host can already decrypt, so secrets were re-encrypted with all current host keys")
+	return nil
+}
+
+// Read this host's public key as a trimmed authorized_keys line
+func readPublicKey() ([]byte, error) {
+	key, err := readFile(secretsID + ".pub")
+	if err != nil {
+		return nil, errors.New("Failed to read public key")
+	}
+	return bytes.TrimSpace(key), nil
+}
+
+// The host name in a public key's comment, which ties a host's old and new
+// keys together in the hosts file
+func keyHostname(key []byte) (string, error) {
+	keyParts := strings.Fields(string(key))
+	if len(keyParts) < 3 {
+		return "", errors.New("Invalid public key format")
+	}
+	return keyParts[2], nil
+}
+
+func cmdAddHost(args []string) error {
+	fs := newFlagSet("add-this-host")
+	useAgent := fs.Bool("agent", false, "Add recipients derived from ssh-agent keys instead of the key file")
+	comment := fs.String("comment", "", "Name to store for this host instead of the key's comment")
+	dryRun := fs.Bool("dry-run", false, "Show the hosts file change without writing anything")
+	parseArgs(fs, args)
+
+	// The name is the last field of the hosts line and what old keys are
+	// matched on, so it has to be a single word that can't start a
+	// description
+	if *comment != "" && strings.ContainsAny(*comment, " \t\r\n#") {
+		return fmt.Errorf("Invalid --comment %q: use a single word without '#'", *comment)
+	}
+
+	if *useAgent {
+		if *comment != "" {
+			return errors.New("--comment can't be used with --agent")
+		}
+		if *dryRun {
+			return errors.New("--dry-run can't be used with --agent")
+		}
+		return addAgentHosts()
+	}
+
+	if *dryRun {
+		return previewAddThisHost(*comment)
+	}
+
+	if err := ensureSecretsID(); err != nil {
+		return err
+	}
+
+	// Create directory if needed
+	if err := makeSecretsDir(); err != nil {
+		return err
+	}
+
+	// Touch the hosts file if it doesn't exist
+	if _, err := os.Stat(secretsHosts); os.IsNotExist(err) && hostsDirFor(secretsHosts) == "" {
+		if err := writeHostsFile([]byte{}); err != nil {
+			return errors.New("Failed to create hosts file")
+		}
+	}
+
+	// Read current public key
+	currentKey, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+	if *comment != "" {
+		fields := strings.Fields(string(currentKey))
+		if len(fields) < 2 {
+			return errors.New("Invalid public key format")
+		}
+		currentKey = []byte(fields[0] + " " + fields[1] + " " + *comment)
+	}
+
+	// Read existing hosts
+	hostsContent, err := readHosts(secretsHosts)
+	if err != nil {
+		return errors.New("Failed to read hosts file")
+	}
+
+	// Check if exact key already exists
+	if hostsContainKey(hostsContent, currentKey) {
+		fmt.Println("This exact key is already authorized")
+		if status, err := hostAccessStatus(); err != nil {
+			return err
+		} else if status != accessOK {
+			fmt.Println("Note: The key still needs to be validated by running 'secrets revalidate' on a machine that can decrypt")
+		}
+		return nil
+	}
+
+	// Extract hostname from key
+	currentHostname, err := keyHostname(currentKey)
+	if err != nil {
+		return err
+	}
+
+	if err := addHostKey(hostsContent, currentKey, currentHostname); err != nil {
+		return err
+	}
+
+	return revalidateAfterAdd("")
+}
+
+// Show what add-this-host would do to the hosts file. Nothing is written,
+// not even a missing key generated.
+func previewAddThisHost(comment string) error {
+	if _, err := os.Stat(secretsID + ".pub"); os.IsNotExist(err) {
+		return fmt.Errorf("No key at %s yet; 'secrets generate-key' creates one", secretsID)
+	}
+	currentKey, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+	if comment != "" {
+		fields := strings.Fields(string(currentKey))
+		if len(fields) < 2 {
+			return errors.New("Invalid public key format")
+		}
+		currentKey = []byte(fields[0] + " " + fields[1] + " " + comment)
+	}
+
+	hostsContent, err := readHosts(secretsHosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to read hosts file")
+	}
+	if hostsContainKey(hostsContent, currentKey) {
+		fmt.Println("This exact key is already authorized; nothing would change")
+		return nil
+	}
+	name, err := keyHostname(currentKey)
+	if err != nil {
+		return err
+	}
+	previewHostKey(hostsContent, currentKey, name)
+	return nil
+}
+
+// Give this host the access an existing host has: its key goes into the
+// hosts file with the source host's description, and so its group: tags.
+// The secrets are then reencrypted here if this host can already decrypt;
+// otherwise the steps left to do on the source host are printed.
+func cmdCloneAccess(args []string) error {
+	args = parseArgs(newFlagSet("clone-access"), args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets clone-access <source-host>")
+	}
+	source := args[0]
+
+	if err := ensureSecretsID(); err != nil {
+		return err
+	}
+
+	hostsContent, err := readHosts(secretsHosts)
+	if err != nil {
+		return fmt.Errorf("Failed to read hosts file: %v", err)
+	}
+	found, description := false, ""
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		key, desc := secrets.SplitHostLine(strings.TrimSpace(line))
+		if hostKeyComment(key) == source {
+			found, description = true, desc
+		}
+	}
+	if !found {
+		return fmt.Errorf("No host named '%s' in %s (see 'secrets list-hosts')", source, secretsHosts)
+	}
+
+	currentKey, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+	name, err := keyHostname(currentKey)
+	if err != nil {
+		return err
+	}
+	if name == source {
+		return fmt.Errorf("This host is '%s' already; run clone-access with another host's name", source)
+	}
+
+	if hostsContainKey(hostsContent, currentKey) {
+		fmt.Println("This host's key is already in the hosts file")
+	} else {
+		line := string(currentKey)
+		if description != "" {
+			line += " # " + description
+		}
+		if dir := hostsDirFor(secretsHosts); dir != "" {
+			if err := addHostKeyFile(dir, []byte(line), name); err != nil {
+				return err
+			}
+		} else {
+			if len(hostsContent) > 0 && !bytes.HasSuffix(hostsContent, []byte("\n")) {
+				hostsContent = append(hostsContent, '\n')
+			}
+			hostsContent = append(hostsContent, line+"\n"...)
+			if err := writeHostsFile(hostsContent); err != nil {
+				return errors.New("Failed to update hosts file")
+			}
+		}
+		if description != "" {
+			fmt.Printf("Added this host as '%s' with %s's description: %s\n", name, source, description)
+		} else {
+			fmt.Printf("Added this host as '%s'\n", name)
+		}
+	}
+
+	// Groups in secrets.yaml list hosts by name and can't be rewritten
+	// without losing its comments, so only point them out
+	rules, err := loadRules(secretsPath)
+	if err != nil {
+		return err
+	}
+	if rules != nil {
+		var missing []string
+		for group, members := range rules.Groups {
+			if slices.Contains(members, source) && !slices.Contains(members, name) {
+				missing = append(missing, group)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			fmt.Printf("Note: add '%s' to the %s group(s) in %s, as '%s' is\n", name, strings.Join(missing, ", "), rulesFileName, source)
+		}
+	}
+
+	return revalidateAfterAdd(source)
+}
+
+// Create this host's SSH key without authorizing it; add-this-host does that
+func cmdGenerateKey(args []string) error {
+	fs := newFlagSet("generate-key")
+	force := fs.Bool("force", false, "Replace an existing key")
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		return errors.New("Usage: secrets generate-key [--force] <ed25519|rsa>")
+	}
+
+	keygenArgs := []string{"-q", "-f", secretsID, "-N", ""}
+	switch args[0] {
+	case "ed25519":
+		keygenArgs = append(keygenArgs, "-t", "ed25519")
+	case "rsa":
+		keygenArgs = append(keygenArgs, "-t", "rsa", "-b", "4096")
+	default:
+		return fmt.Errorf("Unsupported key type '%s' (use ed25519 or rsa)", args[0])
+	}
+
+	if _, err := os.Stat(secretsID); err == nil {
+		if !*force {
+			return fmt.Errorf("%s already exists; pass --force to replace it", secretsID)
+		}
+		// ssh-keygen would ask before overwriting
+		for _, path := range []string{secretsID, secretsID + ".pub"} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed to remove %s: %v", path, err)
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(secretsID), 0700); err != nil {
+		return fmt.Errorf("Failed to create %s: %v", filepath.Dir(secretsID), err)
+	}
+
+	if err := runKeygen(keygenArgs...); err != nil {
+		return err
+	}
+
+	pubKeyBytes, err := readFile(secretsID + ".pub")
+	if err != nil {
+		return errors.New("Failed to read public key")
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse public key: %w", err)
+	}
+
+	fmt.Printf("Generated %s\n", secretsID)
+	fmt.Print(string(pubKeyBytes))
+	fmt.Printf("Fingerprint: %s\n", ssh.FingerprintSHA256(pubKey))
+	fmt.Println()
+	fmt.Println("Run 'secrets add-this-host' to authorize it")
+	return nil
+}
+
+func cmdRotateKey(args []string) error {
+	parseArgs(newFlagSet("rotate-key"), args)
+
+	// Make sure the old key can still decrypt before touching anything
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt with current key: %w", err)
+	}
+	defer zero(content)
+
+	oldKey, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+
+	currentHostname, err := keyHostname(oldKey)
+	if err != nil {
+		return err
+	}
+
+	// Generate the new key next to the old one so it can be renamed into place
+	tmpDir, err := os.MkdirTemp(filepath.Dir(secretsID), ".secrets-rotate")
+	if err != nil {
+		return errors.New("Failed to create temp directory for new key")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	newID := filepath.Join(tmpDir, filepath.Base(secretsID))
+	fmt.Println("Generating new secrets ID...")
+	if err := runKeygen("-q", "-t", "ed25519", "-f", newID, "-N", "", "-C", currentHostname); err != nil {
+		return err
+	}
+
+	newKey, err := readFile(newID + ".pub")
+	if err != nil {
+		return errors.New("Failed to read new public key")
+	}
+	newKey = bytes.TrimSpace(newKey)
+
+	// Swap the old key(s) for this host with the new one
+	hostsDir := hostsDirFor(secretsHosts)
+	hostsContent, err := readFile(secretsHosts)
+	hostsFileExists := err == nil
+	if err != nil && !(os.IsNotExist(err) && hostsDir != "") {
+		return errors.New("Failed to read hosts file")
+	}
+
+	isOld := func(key string) bool {
+		return key == string(oldKey) || hostKeyComment(key) == currentHostname
+	}
+	var newLines []string
+	replaced := 0
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		if line == "" {
+			continue
+		}
+		if key, _ := secrets.SplitHostLine(line); isOld(key) {
+			replaced++
+			continue
+		}
+		newLines = append(newLines, line)
+	}
+
+	// With hosts.d, the old key files go and the new key gets its own
+	var removedFiles map[string][]byte
+	newKeyFile := ""
+	if hostsDir != "" {
+		if removedFiles, err = hostKeyFilesMatching(hostsDir, isOld); err == nil {
+			err = removeHostKeyFiles(removedFiles)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to update %s: %v", hostsDir, err)
+		}
+		replaced += len(removedFiles)
+		newKeyFile = filepath.Join(hostsDir, currentHostname+".pub")
+		if err := writeHostKeyFile(newKeyFile, newKey); err != nil {
+			restoreHostKeyFiles(removedFiles)
+			return errors.New("Failed to write " + newKeyFile)
+		}
+	} else {
+		newLines = append(newLines, string(newKey))
+	}
+
+	if hostsFileExists || newKeyFile == "" {
+		if err := writeHostsFile([]byte(strings.Join(newLines, "\n") + "\n")); err != nil {
+			return errors.New("Failed to update hosts file")
+		}
+	}
+
+	// Re-encrypt with the new key standing in as this host's identity
+	oldID := secretsID
+	secretsID = newID
+	err = encryptSecrets(content)
+	secretsID = oldID
+	if err != nil {
+		if hostsFileExists {
+			if restoreErr := writeHostsFile(hostsContent); restoreErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to restore hosts file: %v\n", restoreErr)
+			}
+		}
+		if newKeyFile != "" {
+			os.Remove(newKeyFile)
+			restoreHostKeyFiles(removedFiles)
+		}
+		return fmt.Errorf("Failed to reencrypt: %w", err)
+	}
+
+	// Finally move the new key into place
+	if err := os.Rename(newID, secretsID); err != nil {
+		return fmt.Errorf("Failed to install new key (it is still at %s): %v", newID, err)
+	}
+	if err := os.Rename(newID+".pub", secretsID+".pub"); err != nil {
+		return fmt.Errorf("Failed to install new public key (it is still at %s.pub): %v", newID, err)
+	}
+
+	fmt.Printf("Key rotated: replaced %d old key(s) for host '%s'\n", replaced, currentHostname)
+	fmt.Println("Secrets have been re-encrypted and the old key can no longer decrypt them")
+	fmt.Println()
+	fmt.Println("Other hosts keep their access and do not need to revalidate, but they must")
+	fmt.Println("pick up the updated secrets.age and secrets.hosts (e.g. commit and pull).")
+	fmt.Println("If the old key is used anywhere else (authorized_keys, git hosting), replace it there too.")
+	return nil
+}
+
+// Drop keys superseded by this host's current one, e.g. an old RSA key left
+// behind after moving to ed25519, then reencrypt without them
+func cmdRekey(args []string) error {
+	parseArgs(newFlagSet("rekey"), args)
+
+	if err := requireAccess(); err != nil {
+		return err
+	}
+
+	currentKey, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+
+	currentHostname, err := keyHostname(currentKey)
+	if err != nil {
+		return err
+	}
+
+	hostsDir := hostsDirFor(secretsHosts)
+	hostsContent, err := readFile(secretsHosts)
+	hostsFileExists := err == nil
+	if err != nil && !(os.IsNotExist(err) && hostsDir != "") {
+		return errors.New("Failed to read hosts file")
+	}
+	// Without the current key listed, dropping the others would lock this
+	// host out
+	if allHosts, err := readHosts(secretsHosts); err != nil || !hostsContainKey(allHosts, currentKey) {
+		return errors.New("This host's current key isn't in the hosts file; run 'secrets add-this-host' first")
+	}
+
+	isSuperseded := func(key string) bool {
+		return !hostsContainKey([]byte(key), currentKey) && hostKeyComment(key) == currentHostname
+	}
+	var newLines, superseded []string
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		if line == "" {
+			continue
+		}
+		if key, _ := secrets.SplitHostLine(line); isSuperseded(key) {
+			superseded = append(superseded, line)
+			continue
+		}
+		newLines = append(newLines, line)
+	}
+	// A hosts.d file holding a superseded key is removed whole
+	var supersededFiles map[string][]byte
+	if hostsDir != "" {
+		if supersededFiles, err = hostKeyFilesMatching(hostsDir, isSuperseded); err != nil {
+			return fmt.Errorf("Failed to read %s: %v", hostsDir, err)
+		}
+		for path := range supersededFiles {
+			superseded = append(superseded, filepath.Join(hostsDirName, filepath.Base(path)))
+		}
+	}
+
+	if len(superseded) == 0 {
+		fmt.Printf("No superseded keys for host '%s'\n", currentHostname)
+		return nil
+	}
+
+	fmt.Printf("Superseded key(s) for host '%s' to remove:\n", currentHostname)
+	for _, line := range superseded {
+		fmt.Println(line)
+	}
+	fmt.Println()
+	fmt.Println("Anything still using these keys will lose access to the secrets.")
+	if !confirm("Remove them and reencrypt?") {
+		fmt.Println("Operation cancelled")
+		return exitCode(1)
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	if hostsFileExists {
+		if err := writeHostsFile([]byte(strings.Join(newLines, "\n") + "\n")); err != nil {
+			return errors.New("Failed to update hosts file")
+		}
+	}
+	if err := removeHostKeyFiles(supersededFiles); err != nil {
+		if hostsFileExists {
+			if restoreErr := writeHostsFile(hostsContent); restoreErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to restore hosts file: %v\n", restoreErr)
+			}
+		}
+		return fmt.Errorf("Failed to update %s: %v", hostsDir, err)
+	}
+	if err := encryptSecrets(content); err != nil {
+		if hostsFileExists {
+			if restoreErr := writeHostsFile(hostsContent); restoreErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to restore hosts file: %v\n", restoreErr)
+			}
+		}
+		restoreHostKeyFiles(supersededFiles)
+		return fmt.Errorf("Failed to reencrypt: %w", err)
+	}
+
+	fmt.Printf("Removed %d superseded key(s) for host '%s' and re-encrypted\n", len(superseded), currentHostname)
+	return nil
+}
+
+func cmdRenameHost(args []string) error {
+	args = parseArgs(newFlagSet("rename-host"), args)
+	if len(args) != 2 {
+		return errors.New("Usage: secrets rename-host <old> <new>")
+	}
+	oldName, newName := args[0], args[1]
+	if strings.ContainsAny(newName, " \t#") {
+		return errors.New("New host name must not contain whitespace or '#'")
+	}
+
+	// age files name recipients by key, never by host name, so only the
+	// hosts file changes and nothing is decrypted
+	hostsContent, err := readFile(secretsHosts)
+	if err != nil && !(os.IsNotExist(err) && hostsDirFor(secretsHosts) != "") {
+		return errors.New("Failed to read hosts file")
+	}
+
+	lines := strings.Split(string(hostsContent), "\n")
+	renamed := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, description := secrets.SplitHostLine(trimmed)
+		fields := strings.Fields(key)
+
+		// Split the key material (type and key, or an age recipient) from
+		// the comment that names the host
+		var material, comment string
+		switch {
+		case strings.HasPrefix(key, "age1"):
+			material, comment = fields[0], strings.Join(fields[1:], " ")
+		case len(fields) >= 2:
+			material, comment = fields[0]+" "+fields[1], strings.Join(fields[2:], " ")
+		default:
+			continue
+		}
+
+		if comment == newName {
+			fmt.Fprintf(os.Stderr, "Warning: host '%s' already exists on line %d\n", newName, i+1)
+		}
+		if comment != oldName {
+			continue
+		}
+
+		newLine := material + " " + newName
+		if description != "" {
+			newLine += " # " + description
+		}
+		lines[i] = newLine
+		renamed++
+	}
+
+	if renamed == 0 {
+		// hosts.d files are named after their host, so renaming is a
+		// file rename better done (and committed) by hand
+		if dir := hostsDirFor(secretsHosts); dir != "" {
+			files, _ := hostKeyFilesMatching(dir, func(key string) bool { return hostKeyComment(key) == oldName })
+			for path := range files {
+				return fmt.Errorf("'%s' is in %s; rename the file and the name inside it by hand, then run 'secrets revalidate'", oldName, path)
+			}
+		}
+		return fmt.Errorf("No host named '%s' in %s", oldName, secretsHosts)
+	}
+
+	if err := writeHostsFile([]byte(strings.Join(lines, "\n"))); err != nil {
+		return errors.New("Failed to update hosts file")
+	}
+
+	fmt.Printf("Renamed %d key(s) from '%s' to '%s'\n", renamed, oldName, newName)
+	if trusted, err := loadTrustedSigners(); err == nil && trusted != nil {
+		fmt.Println("The hosts file changed, so run 'secrets hosts sign' on a machine with a trusted signing key")
+	}
+	return nil
+}
+
+func cmdListHosts(args []string) error {
+	parseArgs(newFlagSet("list-hosts"), args)
+
+	recipients, err := loadSSHRecipients(secretsHosts, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to load hosts: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tFINGERPRINT\tDESCRIPTION")
+	for _, r := range recipients {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Comment, r.Fingerprint, r.Description)
+	}
+	w.Flush()
+	return nil
+}
+
+func cmdCheckHostAccess(args []string) error {
+	fs := newFlagSet("check-host-access")
+	jsonOutput := fs.Bool("json", false, "Print the status as JSON instead of instructions")
+	parseArgs(fs, args)
+
+	if !*jsonOutput {
+		status, err := checkHostAccess()
+		if err != nil {
+			return err
+		}
+		if status == accessOK {
+			fmt.Println(okText("This host can decrypt the secrets."))
+		}
+		return accessError(status)
+	}
+
+	// Never generate a key here; a missing key just isn't in the hosts file
+	status, err := hostAccessStatus()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	out, err := json.Marshal(struct {
+		Status     string `json:"status"`
+		Code       int    `json:"code"`
+		Host       string `json:"host"`
+		InHosts    bool   `json:"in_hosts"`
+		CanDecrypt bool   `json:"can_decrypt"`
+	}{
+		Status:     accessStatusNames[status],
+		Code:       status,
+		Host:       hostname,
+		InHosts:    status != accessNotInHosts && hostListedIn(secretsHosts),
+		CanDecrypt: status == accessOK,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to encode JSON: %w", err)
+	}
+	fmt.Println(string(out))
+	return accessError(status)
+}
+
+// Wrap a command with git: pull --rebase before it runs, then commit and
+// push if it changed the secrets. With no command, just pull and push.
+func cmdSync(args []string) error {
+	if err := requireGitRepo(); err != nil {
+		return err
+	}
+	if err := pullSecrets(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if err := pushSecrets(); err != nil {
+			return err
+		}
+		fmt.Println("Secrets are in sync with the remote")
+		return nil
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "sync" {
+		return errors.New("Usage: secrets sync [command [args...]]")
+	}
+	if err := dispatch(cmd, args); err != nil {
+		return err
+	}
+	if !writingCommands[cmd] {
+		return nil
+	}
+	if err := commitSecrets(cmd); err != nil {
+		return fmt.Errorf("Failed to commit: %w", err)
+	}
+	return pushSecrets()
+}
+
+// Print this host's key fingerprint in ssh-keygen -lf format, for checking
+// a key in the hosts file against the machine it came from
+func cmdFingerprint(args []string) error {
+	parseArgs(newFlagSet("fingerprint"), args)
+
+	key, err := readPublicKey()
+	if err != nil {
+		return err
+	}
+	pubKey, comment, _, _, err := ssh.ParseAuthorizedKey(key)
+	if err != nil {
+		return fmt.Errorf("Failed to parse public key: %w", err)
+	}
+	if comment == "" {
+		comment = "no comment"
+	}
+
+	fmt.Printf("%d %s %s (%s)\n", keyBits(pubKey), ssh.FingerprintSHA256(pubKey), comment, keyTypeName(pubKey))
+	return nil
+}
+
+// Key size in bits as ssh-keygen reports it
+func keyBits(pubKey ssh.PublicKey) int {
+	cryptoKey, ok := pubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+// Key type as ssh-keygen names it, e.g. ED25519 for ssh-ed25519
+func keyTypeName(pubKey ssh.PublicKey) string {
+	switch t := pubKey.Type(); {
+	case strings.HasPrefix(t, "ecdsa-"):
+		return "ECDSA"
+	case strings.HasPrefix(t, "sk-ecdsa-"):
+		return "ECDSA-SK"
+	case strings.HasPrefix(t, "sk-ssh-ed25519"):
+		return "ED25519-SK"
+	default:
+		return strings.ToUpper(strings.TrimPrefix(t, "ssh-"))
+	}
+}
+
+func cmdWhoami(args []string) error {
+	parseArgs(newFlagSet("whoami"), args)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "(unknown)"
+	}
+
+	fingerprint := "(no public key at " + secretsID + ".pub)"
+	inHosts := "no"
+	if pubKeyBytes, err := readFile(secretsID + ".pub"); err == nil {
+		if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes); err == nil {
+			fingerprint = ssh.FingerprintSHA256(pubKey)
+		} else {
+			fingerprint = "(unparseable public key at " + secretsID + ".pub)"
+		}
+		if hostsContent, err := readHosts(secretsHosts); err == nil && hostsContainKey(hostsContent, pubKeyBytes) {
+			inHosts = "yes"
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Host:\t%s\n", hostname)
+	fmt.Fprintf(w, "Key:\t%s\n", secretsID)
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", fingerprint)
+	fmt.Fprintf(w, "In hosts file:\t%s\n", inHosts)
+	if agentIDs, err := loadAgentIdentities(); err == nil {
+		hostsContent, _ := readHosts(secretsHosts)
+		for _, id := range agentIDs {
+			listed := "not in hosts file"
+			if hostsContainRecipient(hostsContent, id.identity.Recipient().String()) {
+				listed = "in hosts file"
+			}
+			fmt.Fprintf(w, "Agent key:\t%s (%s)\n", id.comment, listed)
+		}
+	}
+	status, err := hostAccessStatus()
+	if err != nil {
+		return err
+	}
+	access := fmt.Sprintf("%d (%s)", status, accessDescriptions[status])
+	if status == accessOK {
+		access = okText(access)
+	} else {
+		access = badText(access)
+	}
+	fmt.Fprintf(w, "Access:\t%s\n", access)
+	w.Flush()
+
+	if status != accessOK {
+		fmt.Println()
+		printAccessHelp(status)
+	}
+	return nil
+}
+
+func cmdVersion() error {
+	fmt.Printf("secrets %s\n", version)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	fmt.Printf("go: %s\n", info.GoVersion)
+	for _, dep := range info.Deps {
+		if dep.Path == "filippo.io/age" {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			fmt.Printf("filippo.io/age: %s\n", dep.Version)
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: secrets [global flags] <command>")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  list [--json|--yaml|--keys|--count] [--only KEYS] [--except KEYS] [--section NAME]")
+	fmt.Println("                      Show raw decrypted secrets")
+	fmt.Println("  get [--section NAME] [--decode-base64] KEY")
+	fmt.Println("                      Print the value of one key (decoded to raw bytes)")
+	fmt.Println("  grep [--fixed] [--show-values] <pattern>")
+	fmt.Println("                      List keys matching a regexp (values masked)")
+	fmt.Println("  activate [--prefix PREFIX] [--only KEYS] [--except KEYS] [--section NAME] [--watch] <shell>")
+	fmt.Println("                      Output secrets for shell evaluation")
+	fmt.Println("                      Shells: fish, bash, zsh, sh, powershell (pwsh), github, docker")
+	fmt.Println("                      Usage: secrets activate fish | source")
+	fmt.Println("                             eval \"$(secrets activate bash)\"")
+	fmt.Println("                      github appends to $GITHUB_ENV (stdout when unset)")
+	fmt.Println("                      docker prints bare KEY=value lines for --env-file")
+	fmt.Println("                      --section limits output to keys under a [section] header")
+	fmt.Println("                      Keys matching a name or glob in $SECRETS_PATH/.activateignore")
+	fmt.Println("                      are left out unless named in --only")
+	fmt.Println("                      --watch keeps running and prints set/unset commands for the")
+	fmt.Println("                      keys that changed whenever secrets.age does. With direnv,")
+	fmt.Println("                      use 'watch_file $SECRETS_PATH/secrets.age' in .envrc instead")
+	fmt.Println("                      and nothing is written to disk. Otherwise write them to a")
+	fmt.Println("                      file the shell sources on each prompt, e.g.")
+	fmt.Println("                        umask 077; secrets activate fish --watch > $XDG_RUNTIME_DIR/secrets.fish &")
+	fmt.Println("                      WARNING: that file holds the secrets in plaintext; keep it")
+	fmt.Println("                      mode 0600 on tmpfs, never in your home directory or a backup")
+	fmt.Println("  exec [--prefix PREFIX] [--only KEYS] [--except KEYS] [--section NAME] -- <command>")
+	fmt.Println("                      Run a command with the secrets in its environment, without")
+	fmt.Println("                      printing them; exits with the command's exit code")
+	fmt.Println("  dump-env [--only KEYS] [--except KEYS] [--section NAME]")
+	fmt.Println("                      Print KEY=value pairs for direnv's dotenv parser; in .envrc:")
+	fmt.Println("                        eval \"$(secrets dump-env | direnv dotenv bash /dev/stdin)\"")
+	fmt.Println("                        watch_file \"$SECRETS_PATH/secrets.age\"")
+	fmt.Println("  edit [--diff] [--dedup] [--fifo] [--dry-run] [--editor <cmd>]")
+	fmt.Println("                      Edit secrets in $EDITOR")
+	fmt.Println("                      --diff confirms changed keys before encrypting")
+	fmt.Println("                      --fifo hands the editor a named pipe so plaintext never")
+	fmt.Println("                      lands in a file; editors that reread or rename-save won't work")
+	fmt.Println("                      --dry-run validates the edit and lists the recipients")
+	fmt.Println("                      without saving")
+	fmt.Println("  check               Verify the secrets decrypt and every line is valid")
+	fmt.Println("  audit               Compare the keys secrets.age is encrypted to with the hosts")
+	fmt.Println("                      file (exit code 1 if they drifted apart)")
+	fmt.Println("  inspect [file.age]  List the recipients in an age file's header, naming the")
+	fmt.Println("                      hosts whose SSH keys it matches, without decrypting")
+	fmt.Println("  doctor              Check the setup: SECRETS_PATH, keys and their permissions,")
+	fmt.Println("                      the hosts file, access and the editor, with a fix for each")
+	fmt.Println("                      problem (exit code 1 if a critical check fails)")
+	fmt.Println("  set KEY=value...    Add or update keys, keeping comments and order")
+	fmt.Println("  set KEY -           Set KEY to a value read from stdin (may span lines)")
+	fmt.Println("  set --prompt KEY    Set KEY to a value typed without echo")
+	fmt.Println("  set --encode-base64 KEY -")
+	fmt.Println("                      Set KEY to raw bytes from stdin, stored base64-encoded")
+	fmt.Println("  unset KEY...        Remove keys")
+	fmt.Println("  import [--replace | --append [--overwrite | --keep]] [--dedup] <file>")
+	fmt.Println("                      Merge KEY=value lines from a dotenv file")
+	fmt.Println("                      --append fails if a key already has a different value;")
+	fmt.Println("                      --overwrite takes the imported value, --keep the current one")
+	fmt.Println("  export <file|->     Write decrypted secrets to a file (- for stdout)")
+	fmt.Println("  decrypt [--passphrase]")
+	fmt.Println("                      Decrypt an age file from stdin to stdout")
+	fmt.Println("  encrypt [--passphrase]")
+	fmt.Println("                      Encrypt stdin to stdout for every host in the hosts file")
+	fmt.Println("                      --passphrase uses a typed passphrase instead of any keys,")
+	fmt.Println("                      for machines without a key in the hosts file")
+	fmt.Println("  add-this-host [--agent] [--comment NAME] [--dry-run]")
+	fmt.Println("                      Add current host's key to authorized hosts")
+	fmt.Println("                      --comment stores NAME instead of the key's comment")
+	fmt.Println("                      --agent adds keys held in ssh-agent instead; anyone who")
+	fmt.Println("                      can use the agent, such as root on a host it's forwarded")
+	fmt.Println("                      to with 'ssh -A', can derive the same identity")
+	fmt.Println("                      --dry-run prints the line to add, the old keys it would")
+	fmt.Println("                      replace and the resulting file, without writing")
+	fmt.Println("                      With a hosts.d directory in the secrets directory, new")
+	fmt.Println("                      hosts go in hosts.d/NAME.pub; every *.pub there is read")
+	fmt.Println("                      along with secrets.hosts")
+	fmt.Println("  revalidate [--dry-run] [--force] [--group GROUPS]")
+	fmt.Println("                      Reencrypt secrets with all current host keys")
+	fmt.Println("                      Refuses if the decrypted secrets are empty or invalid,")
+	fmt.Println("                      unless --force is given")
+	fmt.Println("                      --group limits them to hosts tagged group:NAME in the")
+	fmt.Println("                      hosts file (or listed in secrets.yaml)")
+	fmt.Println("                      --dry-run lists the recipients without writing anything")
+	fmt.Println("  reencrypt-all [--sort] [--dry-run] [--force]")
+	fmt.Println("                      Revalidate every NAME.age in the secrets directory,")
+	fmt.Println("                      skipping files this host can't decrypt")
+	fmt.Println("                      --sort orders recipients by fingerprint, so the header")
+	fmt.Println("                      doesn't depend on the order of the hosts file")
+	fmt.Println("  hosts sign          Sign the hosts file with this host's SSH key")
+	fmt.Println("  hosts verify        Check the hosts file's signature")
+	fmt.Println("                      With $SECRETS_TRUSTED_SIGNERS set to a file of trusted")
+	fmt.Println("                      public keys, revalidate and reencrypt-all refuse a hosts")
+	fmt.Println("                      file not signed by one of them")
+	fmt.Println("  hosts add [--comment NAME] <pubkey-file|key>")
+	fmt.Println("                      Authorize another machine by its SSH public key or age")
+	fmt.Println("                      recipient, and reencrypt if this host can decrypt")
+	fmt.Println("  clone-access <source-host>")
+	fmt.Println("                      Add this host with the same description and groups as")
+	fmt.Println("                      another host, then reencrypt or print the steps left")
+	fmt.Println("  merge-hosts [--dry-run] <other.hosts>")
+	fmt.Println("                      Add the hosts in another hosts file whose keys aren't")
+	fmt.Println("                      authorized yet (matched by fingerprint), drop repeated keys")
+	fmt.Println("                      and reencrypt; warns about a name with two different keys")
+	fmt.Println("  rename-host <old> <new>")
+	fmt.Println("                      Change a host's name in the hosts file; the secrets file is")
+	fmt.Println("                      left as it is, since it names hosts by key")
+	fmt.Println("  list-hosts          Show authorized hosts and their descriptions")
+	fmt.Println("  generate-key [--force] <ed25519|rsa>")
+	fmt.Println("                      Create this host's key without adding it to the hosts file")
+	fmt.Println("  rotate-key          Replace this host's key and reencrypt")
+	fmt.Println("  rekey               Drop this host's superseded keys and reencrypt")
+	fmt.Println("  check-host-access [--json]")
+	fmt.Println("                      Check whether this host can decrypt (exit code 0-3)")
+	fmt.Println("  whoami              Show this host's key and whether it can decrypt")
+	fmt.Println("  fingerprint         Print this host's key fingerprint (as ssh-keygen -lf)")
+	fmt.Println("  sync [command...]   Run a command between git pull --rebase and, if it changed")
+	fmt.Println("                      the secrets, a commit and git push (SECRETS_PATH must be")
+	fmt.Println("                      a git repository)")
+	fmt.Println("  completion <shell>  Print a completion script for bash, zsh or fish")
+	fmt.Println("  version             Print version information")
+	fmt.Println()
+	fmt.Println("Global flags:")
+	fmt.Println("  --secrets-path <dir>")
+	fmt.Println("                      Directory holding secrets.age and secrets.hosts")
+	fmt.Println("                      (default $SECRETS_PATH)")
+	fmt.Println("  --file <name>       Use <name>.age and <name>.hosts in the secrets directory")
+	fmt.Println("                      instead of secrets.age and secrets.hosts. If a rule in")
+	fmt.Println("                      secrets.yaml matches <name>, its groups of hosts from")
+	fmt.Println("                      secrets.hosts are used instead of <name>.hosts")
+	fmt.Println("  --strict            Fail instead of skipping unparseable hosts")
+	fmt.Println("  --allow-any-key     Accept key names that aren't valid shell identifiers")
+	fmt.Println("  --key <path>        SSH private key to use (default $SECRETS_ID, or the first")
+	fmt.Println("                      of ~/.ssh/id_ed25519, id_rsa, id_ecdsa usable with age)")
+	fmt.Println("  --version           Print version information")
+	fmt.Println("  --recipients-file <path>")
+	fmt.Println("                      Encrypt to the hosts listed in this file instead of")
+	fmt.Println("                      secrets.hosts (same format)")
+	fmt.Println("  --no-self           Encrypt only to the hosts file, without implicitly adding")
+	fmt.Println("                      this host's key when it isn't listed")
+	fmt.Println("  --commit            Commit changed secrets.age and secrets.hosts with git")
+	fmt.Println("                      (or set SECRETS_AUTOCOMMIT=1)")
+	fmt.Println("  --armor             Write ASCII-armored age files; an armored secrets.age stays")
+	fmt.Println("                      armored when rewritten, and armor is detected on decrypt")
+	fmt.Println("  --backup            Keep a timestamped copy of secrets.age before overwriting")
+	fmt.Println("                      it (keeps $SECRETS_BACKUPS, default 5)")
+	fmt.Println("  --dir-mode <mode>   Create the secrets directory with this octal mode, before")
+	fmt.Println("                      the umask (default 0700)")
+	fmt.Println("  --timeout <dur>     Kill the editor, ssh-keygen, git or $SSH_ASKPASS if it runs")
+	fmt.Println("                      longer than this (e.g. 30s, 10m); the plaintext temp file")
+	fmt.Println("                      is removed")
+	fmt.Println("  -y, --yes           Answer yes to every question")
+	fmt.Println("                      Every command that encrypts asks before granting access to")
+	fmt.Println("                      hosts secrets.age isn't encrypted to yet, other than this")
+	fmt.Println("                      host and ones added by the same command")
+	fmt.Println("  --non-interactive   Never prompt; answer no to every question")
+	fmt.Println("                      (default when CI=true)")
+	fmt.Println("  --mask              Mask secret values in output (or set SECRETS_MASK=1)")
+	fmt.Println("  --no-color          Don't color messages on a terminal (or set NO_COLOR)")
+	fmt.Println("  -v, --verbose       Log what the tool is doing to stderr")
+	fmt.Println()
+	fmt.Println("Exit codes:")
+	fmt.Println("  0   Success")
+	fmt.Println("  1   General failure, or no secrets file yet")
+	fmt.Println("  2   This host's key is not in the hosts file")
+	fmt.Println("  3   This host's key is in the hosts file but cannot decrypt")
+	fmt.Println("  10  No SSH key or age identity to decrypt with")
+	fmt.Println("  11  Decryption failed")
+	fmt.Println("  12  Secrets failed validation")
+}
+
+func main() {
+	// Global flags before the command name; each command parses the rest
+	global := newFlagSet("secrets")
+	showVersion := global.Bool("version", false, "Print version information")
+	global.Parse(os.Args[1:])
+	args := global.Args()
+
+	if err := run(args, *showVersion); err != nil {
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		var coded codedError
+		if errors.As(err, &coded) {
+			fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, ansiRed, "Error:"), err)
+			os.Exit(coded.code)
+		}
+		die(err.Error())
+	}
+}
+
+// Dispatch to the command named in args; main is the only place that exits
+func run(args []string, showVersion bool) error {
+	// version and completion don't need a secrets directory
+	if showVersion || (len(args) > 0 && args[0] == "version") {
+		return cmdVersion()
+	}
+	if len(args) > 0 && args[0] == "completion" {
+		return cmdCompletion(args[1:])
+	}
+	// doctor reports a missing secrets directory rather than failing on it
+	if len(args) > 0 && args[0] == "doctor" {
+		return cmdDoctor(args[1:])
+	}
+
+	if err := setupPaths(); err != nil {
+		return err
+	}
+
+	if len(args) < 1 {
+		usage()
+		return exitCode(1)
+	}
+
+	// Commands that only check access never take the plaintext
+	defer discardAccessPlaintext()
+
+	cmd, args := args[0], args[1:]
+	if err := dispatch(cmd, args); err != nil {
+		return err
+	}
+	if autoCommit && writingCommands[cmd] {
+		if err := commitSecrets(cmd); err != nil {
+			return fmt.Errorf("Failed to commit: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run the command named cmd
+func dispatch(cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		return cmdList(args)
+	case "activate":
+		return cmdActivate(args)
+	case "exec":
+		return cmdExec(args)
+	case "dump-env":
+		return cmdDumpEnv(args)
+	case "get":
+		return cmdGet(args)
+	case "grep":
+		return cmdGrep(args)
+	case "check":
+		return cmdCheck(args)
+	case "inspect":
+		return cmdInspect(args)
+	case "audit":
+		return cmdAudit(args)
+	case "edit":
+		return cmdEdit(args)
+	case "clone-access":
+		return cmdCloneAccess(args)
+	case "hosts":
+		return cmdHosts(args)
+	case "merge-hosts":
+		return cmdMergeHosts(args)
+	case "add-this-host":
+		return cmdAddHost(args)
+	case "set":
+		return cmdSet(args)
+	case "unset":
+		return cmdUnset(args)
+	case "import":
+		return cmdImport(args)
+	case "export":
+		return cmdExport(args)
+	case "decrypt":
+		return cmdDecrypt(args)
+	case "encrypt":
+		return cmdEncrypt(args)
+	case "reencrypt-all":
+		return cmdReencryptAll(args)
+	case "revalidate":
+		return cmdRevalidate(args)
+	case "rename-host":
+		return cmdRenameHost(args)
+	case "list-hosts":
+		return cmdListHosts(args)
+	case "generate-key":
+		return cmdGenerateKey(args)
+	case "rotate-key":
+		return cmdRotateKey(args)
+	case "rekey":
+		return cmdRekey(args)
+	case "check-host-access":
+		return cmdCheckHostAccess(args)
+	case "whoami":
+		return cmdWhoami(args)
+	case "fingerprint":
+		return cmdFingerprint(args)
+	case "sync":
+		return cmdSync(args)
+	default:
+		return fmt.Errorf("Unknown command '%s'", cmd)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A throwaway host for tests: an ed25519 key in a temporary home and an
+// empty secrets directory, with every command pointed at them
+type testHost struct {
+	dir    string // SECRETS_PATH
+	key    string // Private key path; the public key is key + ".pub"
+	pubKey []byte // authorized_keys line, comment included
+}
+
+// Set up a throwaway host and reset the state a previous test (or command)
+// left behind. The hosts file and secrets file are left for the test.
+func newTestHost(t testing.TB) *testHost {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Setenv("AGE_IDENTITY", "")
+	t.Setenv("SECRETS_PATH", "")
+	t.Setenv("SECRETS_ID", "")
+
+	key, pubKey := writeTestKey(t, filepath.Join(home, ".ssh"), "id_ed25519", "testhost")
+	h := &testHost{dir: filepath.Join(home, "secrets"), key: key, pubKey: pubKey}
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(resetState)
+	h.use(t, h.key)
+	return h
+}
+
+// Forget everything a run caches, as if the process started again
+func resetState() {
+	loadedIdentities = nil
+	agentIdentities = nil
+	agentLoaded = false
+	warnedForwarded = false
+	discardAccessPlaintext()
+	approvedGrants = make(map[string]bool)
+	warnedPermissions = make(map[string]bool)
+	encryptedFiles = nil
+	assumeYes = false
+	nonInteractive = true
+	recipientsFile = ""
+	noSelf = false
+	strict = false
+	allowAnyKey = false
+	sortRecipients = false
+	secretsPath = ""
+	secretsID = ""
+	secretsName = "secrets"
+}
+
+// Write a new ed25519 key pair to dir/name and dir/name.pub, returning the
+// private key's path and the public key line
+func writeTestKey(t testing.TB, dir, name, comment string) (string, []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := ssh.MarshalAuthorizedKey(sshPub)
+	pubKey := append(line[:len(line)-1], " "+comment+"\n"...)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".pub", pubKey, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, pubKey
+}
+
+// Write the hosts file, one line per key
+func (h *testHost) writeHosts(t testing.TB, lines ...[]byte) {
+	t.Helper()
+	var content []byte
+	for _, line := range lines {
+		content = append(content, line...)
+	}
+	if err := os.WriteFile(secretsHosts, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Switch to running as the host with the private key at key, as a fresh
+// process would
+func (h *testHost) use(t testing.TB, key string) {
+	t.Helper()
+	resetState()
+	if err := useConfig(config{SecretsPath: h.dir, SecretsID: key}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run f and return what it printed to stdout
+func captureStdout(t testing.TB, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	return string(<-out), err
+}
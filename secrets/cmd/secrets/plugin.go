@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/shardul/secrets"
+)
+
+// Lets age plugins (age-plugin-yubikey and friends) talk to the user while
+// they decrypt: PIN prompts, touch reminders and confirmations all go to
+// the terminal, never stdout
+var pluginUI = &plugin.ClientUI{
+	DisplayMessage: func(name, message string) error {
+		fmt.Fprintf(os.Stderr, "age-plugin-%s: %s\n", name, message)
+		return nil
+	},
+	RequestValue: func(name, prompt string, secret bool) (string, error) {
+		if secret {
+			return readSecretValue(fmt.Sprintf("age-plugin-%s: %s ", name, prompt))
+		}
+		return readTerminalLine(fmt.Sprintf("age-plugin-%s: %s ", name, prompt))
+	},
+	Confirm: func(name, prompt, yes, no string) (bool, error) {
+		if no == "" {
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: %s (%s)\n", name, prompt, yes)
+			return true, nil
+		}
+		return confirm(fmt.Sprintf("age-plugin-%s: %s", name, prompt)), nil
+	},
+	WaitTimer: func(name string) {
+		fmt.Fprintf(os.Stderr, "Waiting for age-plugin-%s (touch your security key?)\n", name)
+	},
+}
+
+// Read one line from the terminal, echoed
+func readTerminalLine(prompt string) (string, error) {
+	if nonInteractive {
+		return "", fmt.Errorf("a plugin asked for input but --non-interactive is set")
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to read from: %w", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Parse an age identity file line by line, so plugin identities
+// (AGE-PLUGIN-...) can sit next to native ones (AGE-SECRET-KEY-...)
+func parseAgeIdentities(content []byte, path string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "AGE-PLUGIN-") {
+			identity, err := plugin.NewIdentity(line, pluginUI)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+			}
+			debugf("using age-plugin-%s identity from %s", identity.Name(), path)
+			identities = append(identities, identity)
+			continue
+		}
+		identity, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found in %s", path)
+	}
+	return identities, nil
+}
+
+// Report whether the hosts file lists a recipient for the age identity
+// file. Plugin identities can't name their recipient without running the
+// plugin, so any recipient of the same plugin counts.
+func hostsContainAgeIdentity(hostsContent []byte) bool {
+	if _, err := os.Stat(secretsAgeID); err != nil {
+		return false
+	}
+	identities, err := loadAgeIdentities(secretsAgeID)
+	if err != nil {
+		debugf("%v", err)
+		return false
+	}
+	for _, identity := range identities {
+		switch id := identity.(type) {
+		case *age.X25519Identity:
+			if hostsContainRecipient(hostsContent, id.Recipient().String()) {
+				return true
+			}
+		case *plugin.Identity:
+			if hostsContainPluginRecipient(hostsContent, id.Name()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report whether the hosts file lists an age1<name>1... recipient
+func hostsContainPluginRecipient(hostsContent []byte, name string) bool {
+	prefix := "age1" + strings.ToLower(name) + "1"
+	for _, line := range strings.Split(string(hostsContent), "\n") {
+		key, _ := secrets.SplitHostLine(strings.TrimSpace(line))
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
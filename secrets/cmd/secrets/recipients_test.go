@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// This host is added to the recipients once, whether or not the hosts file
+// already lists it, under its own comment or another one
+func TestEncryptionHostsSelfDedup(t *testing.T) {
+	renamed := func(h *testHost) []byte {
+		fields := bytes.Fields(h.pubKey)
+		return []byte(string(fields[0]) + " " + string(fields[1]) + " renamed\n")
+	}
+	tests := []struct {
+		name  string
+		hosts func(h *testHost, other []byte) [][]byte
+		want  int
+	}{
+		{"listed", func(h *testHost, other []byte) [][]byte { return [][]byte{h.pubKey, other} }, 2},
+		{"listed last", func(h *testHost, other []byte) [][]byte { return [][]byte{other, h.pubKey} }, 2},
+		{"listed under another name", func(h *testHost, other []byte) [][]byte { return [][]byte{renamed(h), other} }, 2},
+		{"listed twice", func(h *testHost, other []byte) [][]byte { return [][]byte{h.pubKey, other, renamed(h)} }, 2},
+		{"not listed", func(h *testHost, other []byte) [][]byte { return [][]byte{other} }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHost(t)
+			_, other := writeTestKey(t, t.TempDir(), "id_ed25519", "otherhost")
+			h.writeHosts(t, tt.hosts(h, other)...)
+
+			hosts, err := encryptionHosts()
+			if err != nil {
+				t.Fatalf("encryptionHosts: %v", err)
+			}
+			seen := make(map[string]bool)
+			for _, r := range hosts {
+				if seen[r.Fingerprint] {
+					t.Errorf("%s (%s) is a recipient twice", r.Fingerprint, r.Comment)
+				}
+				seen[r.Fingerprint] = true
+			}
+			if len(hosts) != tt.want {
+				t.Errorf("encryptionHosts returned %d recipients, want %d", len(hosts), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shardul/secrets"
+)
+
+// Encrypt to recipients in fingerprint order rather than hosts file order,
+// for reencrypt-all --sort
+var sortRecipients bool
+
+// Sort recipients by fingerprint under --sort, so the age header lists the
+// same stanzas in the same order however the hosts file is arranged
+func sortedRecipients(recipients []secrets.Recipient) []secrets.Recipient {
+	if sortRecipients {
+		sort.SliceStable(recipients, func(i, j int) bool {
+			return recipients[i].Fingerprint < recipients[j].Fingerprint
+		})
+	}
+	return recipients
+}
+
+// Reencrypt every secrets file in the secrets directory to its current
+// hosts, like running revalidate with each --file. Files this host can't
+// decrypt are skipped rather than failing the rest.
+func cmdReencryptAll(args []string) error {
+	fs := newFlagSet("reencrypt-all")
+	sortFlag := fs.Bool("sort", false, "Encrypt to recipients sorted by fingerprint for a stable header")
+	dryRun := fs.Bool("dry-run", false, "Show the recipients of each file without reencrypting")
+	force := fs.Bool("force", false, "Reencrypt even if the decrypted secrets are empty or invalid")
+	if args = parseArgs(fs, args); len(args) != 0 {
+		return errors.New("Usage: secrets reencrypt-all [--sort] [--dry-run] [--force]")
+	}
+	sortRecipients = *sortFlag
+
+	names, err := secretsFileNames()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("No secrets files found in %s", secretsPath)
+	}
+
+	var skipped []string
+	for _, name := range names {
+		if err := setSecretsName(name); err != nil {
+			return err
+		}
+		status, err := hostAccessStatus()
+		if err != nil {
+			return fmt.Errorf("%s.age: %w", name, err)
+		}
+		if status != accessOK {
+			fmt.Printf("Skipping %s.age: %s\n", name, accessDescriptions[status])
+			skipped = append(skipped, name+".age")
+			continue
+		}
+
+		if *dryRun {
+			fmt.Printf("%s.age:\n", name)
+			if err := printEncryptionHosts(); err != nil {
+				return fmt.Errorf("%s.age: %w", name, err)
+			}
+			continue
+		}
+
+		if err := reencryptCurrent(*force); err != nil {
+			return fmt.Errorf("%s.age: %w", name, err)
+		}
+		fmt.Printf("Reencrypted %s.age\n", name)
+	}
+
+	if len(skipped) > 0 {
+		fmt.Printf("\n%d file(s) were skipped: %s\n", len(skipped), strings.Join(skipped, ", "))
+		fmt.Println("Run 'secrets reencrypt-all' on a machine that can decrypt them")
+		return exitCode(1)
+	}
+	return nil
+}
+
+// Decrypt the current secrets file and encrypt it again unchanged, with
+// revalidate's checks against storing a truncated or garbled copy or
+// encrypting to an unsigned hosts file
+func reencryptCurrent(force bool) error {
+	if err := requireSignedHosts(); err != nil {
+		return err
+	}
+
+	content, err := decryptToBytes()
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt: %w", err)
+	}
+	defer zero(content)
+
+	if !force {
+		if len(bytes.TrimSpace(content)) == 0 {
+			return codedError{exitInvalid, errors.New("Decrypted secrets are empty, not reencrypting (use --force if that's intended)")}
+		}
+		if _, err := validateEnv(content); err != nil {
+			return codedError{exitInvalid, fmt.Errorf("Decrypted secrets are invalid, not reencrypting (use --force to reencrypt anyway): %w", err)}
+		}
+	}
+
+	if err := encryptSecrets(content); err != nil {
+		return fmt.Errorf("Failed to reencrypt: %w", err)
+	}
+	return nil
+}
+
+// Names of the age-encrypted NAME.age files in the secrets directory, in
+// order. The age identity file and anything else that isn't an encrypted
+// file are left out.
+func secretsFileNames() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(secretsPath, "*.age"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if _, err := secrets.ReadStanzas(path); err != nil {
+			debugf("skipping %s: %v", path, err)
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".age")
+		if checkSecretsName(name) != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
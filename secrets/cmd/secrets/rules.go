@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/shardul/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// Optional secrets.yaml in the secrets directory, in the spirit of sops
+// creation rules: named groups of hosts (by the name in their key comment)
+// and rules choosing which groups a secrets file is encrypted to, e.g.
+//
+//	groups:
+//	  work: [laptop, work-desktop]
+//	  personal: [laptop, nas]
+//	rules:
+//	  - files: work*
+//	    groups: [work]
+//
+// A rule can also name a group that hosts only join with a "group:" tag in
+// secrets.hosts. A file matched by a rule takes its hosts from secrets.hosts;
+// files no rule matches keep using their own NAME.hosts.
+type rulesConfig struct {
+	Groups map[string][]string `yaml:"groups"`
+	Rules  []struct {
+		Files  string   `yaml:"files"`
+		Groups []string `yaml:"groups"`
+	} `yaml:"rules"`
+}
+
+const rulesFileName = "secrets.yaml"
+
+// Groups the current --file is encrypted to under secrets.yaml, or nil to
+// encrypt to every host in secretsHosts
+var fileGroups []string
+
+// Read secrets.yaml from dir. A missing file is not an error and returns nil.
+func loadRules(dir string) (*rulesConfig, error) {
+	content, err := readFile(filepath.Join(dir, rulesFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c rulesConfig
+	var tagged map[string]bool
+	if err := yaml.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", rulesFileName, err)
+	}
+	for i, rule := range c.Rules {
+		if _, err := path.Match(rule.Files, ""); err != nil || rule.Files == "" {
+			return nil, fmt.Errorf("invalid %s: rule %d has a bad files pattern %q", rulesFileName, i+1, rule.Files)
+		}
+		if len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("invalid %s: rule %d names no groups", rulesFileName, i+1)
+		}
+		for _, group := range rule.Groups {
+			if _, ok := c.Groups[group]; ok {
+				continue
+			}
+			// Hosts can also join a group with a group: tag in secrets.hosts
+			if tagged == nil {
+				tagged = taggedGroups(dir)
+			}
+			if !tagged[group] {
+				return nil, fmt.Errorf("invalid %s: rule %d uses group %q, which is neither defined there nor tagged in secrets.hosts", rulesFileName, i+1, group)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Groups that hosts in dir's secrets.hosts (and hosts.d) join with a group:
+// tag. An unreadable hosts file tags nothing.
+func taggedGroups(dir string) map[string]bool {
+	groups := make(map[string]bool)
+	hostsContent, err := readHosts(filepath.Join(dir, "secrets.hosts"))
+	if err != nil {
+		return groups
+	}
+	recipients, _ := secrets.ParseHosts(hostsContent)
+	for _, r := range recipients {
+		for _, group := range r.Groups {
+			groups[group] = true
+		}
+	}
+	return groups
+}
+
+// The groups of the first rule whose pattern matches name, or nil
+func (c *rulesConfig) groupsFor(name string) []string {
+	for _, rule := range c.Rules {
+		if ok, _ := path.Match(rule.Files, name); ok {
+			return rule.Groups
+		}
+	}
+	return nil
+}
+
+// Names of the hosts in any of groups
+func (c *rulesConfig) members(groups []string) map[string]bool {
+	names := make(map[string]bool)
+	for _, group := range groups {
+		for _, name := range c.Groups[group] {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Rule groups can come from secrets.yaml or from group: tags in
+// secrets.hosts, but must exist in one of them
+func TestLoadRulesGroups(t *testing.T) {
+	hosts := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGm1cgbHkTq3pU4gnBuHHb3yQkrHwGDQ1bnrDiY+UjFq laptop # group:admins\n"
+	tests := []struct {
+		name, yaml, err string
+	}{
+		{"defined", "groups:\n  work: [laptop]\nrules:\n  - files: work*\n    groups: [work]\n", ""},
+		{"tagged", "rules:\n  - files: admin*\n    groups: [admins]\n", ""},
+		{"both", "groups:\n  work: [laptop]\nrules:\n  - files: '*'\n    groups: [work, admins]\n", ""},
+		{"neither", "rules:\n  - files: '*'\n    groups: [typo]\n", `group "typo"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "secrets.hosts"), []byte(hosts), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, rulesFileName), []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadRules(dir)
+			if tt.err == "" && err != nil {
+				t.Errorf("loadRules: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("loadRules error = %v, want one mentioning %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/shardul/secrets"
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace of hosts file signatures, so a signature made for anything else
+// with the same key (a git commit, a file) can't be replayed here
+const hostsSigNamespace = "secrets-hosts"
+
+// The detached signature of a hosts file, next to it
+func hostsSigPath(hostsPath string) string {
+	return hostsPath + ".sig"
+}
+
+// Sign the hosts file, and the hosts.d files that go with it, with this
+// host's SSH key (or its ssh-agent copy), writing an SSH signature
+// (ssh-keygen -Y sign) next to it
+func cmdHostsSign(args []string) error {
+	if args = parseArgs(newFlagSet("hosts sign"), args); len(args) != 0 {
+		return errors.New("Usage: secrets hosts sign")
+	}
+	path := encryptionHostsPath()
+	hostsContent, err := readHosts(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read hosts file: %w", err)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ssh-keygen", "-Y", "sign", "-f", secretsID, "-n", hostsSigNamespace)
+	cmd.Stdin = bytes.NewReader(hostsContent)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sig, err := cmd.Output()
+	if err := timeoutError(ctx, "ssh-keygen", err); err != nil {
+		if msg := strings.TrimSpace(strings.TrimPrefix(stderr.String(), "Signing data on standard input")); msg != "" {
+			return fmt.Errorf("Failed to sign %s: %s", path, msg)
+		}
+		return fmt.Errorf("Failed to sign %s: %w", path, err)
+	}
+
+	err = secrets.WriteFileAtomic(hostsSigPath(path), 0644, func(w io.Writer) error {
+		_, err := w.Write(sig)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write signature: %w", err)
+	}
+
+	signer, err := verifySignature(hostsContent, sig)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s with %s\n", path, ssh.FingerprintSHA256(signer))
+	if trusted, err := loadTrustedSigners(); err == nil && trusted != nil && !isTrustedSigner(trusted, signer) {
+		fmt.Fprintf(os.Stderr, "Warning: this key is not in $SECRETS_TRUSTED_SIGNERS, so the signature won't be accepted here\n")
+	}
+	return nil
+}
+
+// Check the hosts file's signature and say who made it
+func cmdHostsVerify(args []string) error {
+	if args = parseArgs(newFlagSet("hosts verify"), args); len(args) != 0 {
+		return errors.New("Usage: secrets hosts verify")
+	}
+	path := encryptionHostsPath()
+	if os.Getenv("SECRETS_TRUSTED_SIGNERS") == "" {
+		return fmt.Errorf("SECRETS_TRUSTED_SIGNERS is not set, so there are no signers to check %s against", path)
+	}
+	signer, err := verifyHostsFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is signed by trusted key %s\n", path, ssh.FingerprintSHA256(signer))
+	return nil
+}
+
+// Fail unless the hosts file about to be encrypted to carries a signature by
+// a trusted signer. Without $SECRETS_TRUSTED_SIGNERS nothing is checked.
+func requireSignedHosts() error {
+	if os.Getenv("SECRETS_TRUSTED_SIGNERS") == "" {
+		return nil
+	}
+	signer, err := verifyHostsFile(encryptionHostsPath())
+	if err != nil {
+		return err
+	}
+	debugf("hosts file signed by %s", ssh.FingerprintSHA256(signer))
+	return nil
+}
+
+// Verify the signature of the hosts file at path against the trusted
+// signers, returning the key that made it
+func verifyHostsFile(path string) (ssh.PublicKey, error) {
+	trusted, err := loadTrustedSigners()
+	if err != nil {
+		return nil, err
+	}
+	hostsContent, err := readHosts(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read hosts file: %w", err)
+	}
+	sig, err := readFile(hostsSigPath(path))
+	if os.IsNotExist(err) {
+		return nil, codedError{exitInvalid, fmt.Errorf("%s is not signed; run 'secrets hosts sign' on a machine with a trusted key", path)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read signature: %w", err)
+	}
+
+	signer, err := verifySignature(hostsContent, sig)
+	if err != nil {
+		return nil, codedError{exitInvalid, fmt.Errorf("%s does not match its signature (changed since it was signed?): %w", path, err)}
+	}
+	if !isTrustedSigner(trusted, signer) {
+		return nil, codedError{exitInvalid, fmt.Errorf("%s is signed by %s, which is not a trusted signer", path, ssh.FingerprintSHA256(signer))}
+	}
+	return signer, nil
+}
+
+// Read the public keys in $SECRETS_TRUSTED_SIGNERS, an authorized_keys
+// style file kept outside the secrets directory so that whoever can write
+// the hosts file can't also vouch for it. Returns nil when it isn't set.
+func loadTrustedSigners() ([]ssh.PublicKey, error) {
+	path := os.Getenv("SECRETS_TRUSTED_SIGNERS")
+	if path == "" {
+		return nil, nil
+	}
+	content, err := readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read trusted signers: %w", err)
+	}
+
+	var keys []ssh.PublicKey
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted signers found in %s", path)
+	}
+	return keys, nil
+}
+
+func isTrustedSigner(trusted []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, t := range trusted {
+		if bytes.Equal(t.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check an armored SSH signature (the SSHSIG format of ssh-keygen -Y sign)
+// of message in the hosts namespace, returning the key that made it
+func verifySignature(message, armored []byte) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("not an SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte("SSHSIG"))
+	if !ok {
+		return nil, errors.New("not an SSH signature")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported signature version %d", sig.Version)
+	}
+	if sig.Namespace != hostsSigNamespace {
+		return nil, fmt.Errorf("signature is for %q, not %q", sig.Namespace, hostsSigNamespace)
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha512":
+		h = sha512.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, fmt.Errorf("unsupported signature hash %q", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signing key: %w", err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+	if err := key.Verify(signed, &signature); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
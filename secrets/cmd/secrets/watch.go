@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/shardul/secrets"
+)
+
+// How long the secrets file has to stay quiet after a change before it's
+// decrypted again, since one save (or git checkout) is several events
+const watchSettle = 200 * time.Millisecond
+
+// Watch the secrets file for activate --watch, printing commands that bring
+// a shell from current to each new version: set for added or changed keys,
+// unset for removed ones.
+//
+// With direnv none of this is needed: 'watch_file $SECRETS_PATH/secrets.age'
+// in .envrc makes it rerun 'secrets activate bash' when the file changes,
+// and nothing is written to disk. Prefer that.
+//
+// Otherwise the output has to go to a file the shell sources, since a shell
+// can't be made to re-source anything. That file holds the secrets in
+// plaintext, so keep it private, on tmpfs and out of backups, e.g.:
+//
+//	umask 077; secrets activate fish --watch > $XDG_RUNTIME_DIR/secrets.fish &
+//	function __secrets_refresh --on-event fish_prompt
+//	    source $XDG_RUNTIME_DIR/secrets.fish
+//	end
+//
+// Every line sets or unsets a variable outright, so sourcing the whole file
+// again, old updates included, always ends at the latest secrets.
+func watchActivate(shell string, current []envVar, selectVars func([]byte) ([]envVar, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Failed to watch %s: %w", secretsFile, err)
+	}
+	defer watcher.Close()
+
+	// Editors, git and WriteFileAtomic replace the file rather than write
+	// it in place, so watch the directory it's in
+	if err := watcher.Add(filepath.Dir(secretsFile)); err != nil {
+		return fmt.Errorf("Failed to watch %s: %w", secretsFile, err)
+	}
+	debugf("watching %s", secretsFile)
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(secretsFile) && event.Op != fsnotify.Chmod {
+				settled = time.After(watchSettle)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return fmt.Errorf("Failed watching %s: %w", secretsFile, err)
+		case <-settled:
+			settled = nil
+			vars, err := reloadActivate(selectVars)
+			if err != nil {
+				// Keep the shell as it is until a version decrypts
+				fmt.Fprintf(os.Stderr, "Warning: not updating from %s: %v\n", secretsFile, err)
+				continue
+			}
+			if err := printActivateChanges(shell, current, vars); err != nil {
+				return err
+			}
+			current = vars
+		}
+	}
+}
+
+// Decrypt the secrets file again and select the variables to activate.
+// Unlike decryptToBytes this never prints access help, which would end up in
+// the output meant for the shell.
+func reloadActivate(selectVars func([]byte) ([]envVar, error)) ([]envVar, error) {
+	identities, err := loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := secrets.DecryptFile(secretsFile, identities...)
+	if err != nil {
+		return nil, err
+	}
+	content := normalizeNewlines(plaintext)
+	zero(plaintext)
+	defer zero(content)
+	return selectVars(content)
+}
+
+// Print the commands taking shell from the variables in old to those in
+// vars, in the order of vars with removals last
+func printActivateChanges(shell string, old, vars []envVar) error {
+	oldValues := make(map[string]string)
+	for _, v := range old {
+		oldValues[v.key] = v.value
+	}
+	defined := make(map[string]bool)
+	var changed []envVar
+	for _, v := range vars {
+		defined[v.key] = true
+		if value, ok := oldValues[v.key]; !ok || value != v.value {
+			changed = append(changed, v)
+		}
+	}
+
+	if err := printActivate(shell, changed); err != nil {
+		return err
+	}
+	removed := 0
+	for _, v := range old {
+		if !defined[v.key] {
+			removed++
+			fmt.Println(unsetCommand(shell, v.key))
+		}
+	}
+	debugf("%d key(s) set, %d unset", len(changed), removed)
+	return nil
+}
+
+// The command removing key from the environment in shell
+func unsetCommand(shell, key string) string {
+	switch shell {
+	case "fish":
+		return "set -e " + key
+	case "powershell", "pwsh":
+		return "Remove-Item Env:" + key + " -ErrorAction SilentlyContinue"
+	default:
+		return "unset " + key
+	}
+}
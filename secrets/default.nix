@@ -6,7 +6,12 @@ buildGoModule rec {
 
   src = ./.;
 
-  vendorHash = "sha256-H0jabIQ5EgXvpOr0FOMUXSziXuzRXYzMEkhM2EagVKU=";
+  vendorHash = "sha256-HDioDC7zO84KSzp25+v8KIKg2cpqwSHWF2Fqyt19ZiI=";
+
+  # The module root is the library; only build the command
+  subPackages = [ "cmd/secrets" ];
+
+  ldflags = [ "-X main.version=${version}" ];
 
   meta = with lib; {
     description = "Age-based secrets management tool";
@@ -0,0 +1,189 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A KEY<<TAG line starts a heredoc block for multiline values such as PEM
+// keys: the lines after it, up to one that is just TAG, are KEY's value
+var heredocStart = regexp.MustCompile(`^\s*([^\s=#<]+)<<([A-Za-z_][A-Za-z0-9_]*)\s*$`)
+
+// HeredocStart recognizes the KEY<<TAG line that opens a heredoc block
+func HeredocStart(line string) (key, tag string, ok bool) {
+	m := heredocStart.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// SplitEnvLines splits secrets into logical lines: one per physical line,
+// except that a heredoc block, from KEY<<TAG to its closing TAG line, is a
+// single line with embedded newlines. A block that is never closed is left
+// as separate lines.
+func SplitEnvLines(content []byte) []string {
+	physical := strings.Split(string(content), "\n")
+	var lines []string
+	for i := 0; i < len(physical); i++ {
+		end := i
+		if _, tag, ok := HeredocStart(physical[i]); ok {
+			for j := i + 1; j < len(physical); j++ {
+				if strings.TrimSpace(physical[j]) == tag {
+					end = j
+					break
+				}
+			}
+		}
+		lines = append(lines, strings.Join(physical[i:end+1], "\n"))
+		i = end
+	}
+	return lines
+}
+
+// SplitEnvLine splits a KEY=value line on the first '=' so values may
+// themselves contain '='. Blank lines, comments and lines without '=' are
+// not variables. Quoted values are unquoted (see UnquoteEnvValue), and a
+// heredoc block from SplitEnvLines gives the lines between its first and
+// last line as the value.
+func SplitEnvLine(line string) (key, value string, ok bool) {
+	if first, _, multiline := strings.Cut(line, "\n"); multiline {
+		if key, _, ok := HeredocStart(first); ok {
+			body := line[len(first)+1:]
+			if end := strings.LastIndexByte(body, '\n'); end >= 0 {
+				return key, body[:end], true
+			}
+			return key, "", true
+		}
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), UnquoteEnvValue(strings.TrimSpace(parts[1])), true
+}
+
+// UnquoteEnvValue removes dotenv-style quotes around a whole value. Inside
+// single quotes everything is literal; inside double quotes \n, \r, \t, \"
+// and \\ are escapes. Values that aren't wholly quoted, like a"b" or "a,
+// are returned unchanged.
+func UnquoteEnvValue(value string) string {
+	if len(value) < 2 || (value[0] != '"' && value[0] != '\'') || value[len(value)-1] != value[0] {
+		return value
+	}
+	inner := value[1 : len(value)-1]
+	if value[0] == '\'' {
+		return inner
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(inner); i++ {
+		if inner[i] != '\\' || i+1 == len(inner) {
+			b.WriteByte(inner[i])
+			continue
+		}
+		i++
+		switch inner[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\':
+			b.WriteByte(inner[i])
+		default:
+			// Not an escape; keep the backslash
+			b.WriteByte('\\')
+			b.WriteByte(inner[i])
+		}
+	}
+	return b.String()
+}
+
+// FormatEnvLine writes a variable so SplitEnvLines and SplitEnvLine read it
+// back unchanged. Multiline values become a KEY<<END heredoc block, with
+// another tag if one of the value's lines is END; values with carriage
+// returns are double-quoted instead, since those don't survive editing.
+func FormatEnvLine(key, value string) string {
+	if !strings.Contains(value, "\n") || strings.Contains(value, "\r") {
+		return key + "=" + QuoteEnvValue(value)
+	}
+	tag := "END"
+	for n := 2; hasLine(value, tag); n++ {
+		tag = fmt.Sprintf("END%d", n)
+	}
+	return key + "<<" + tag + "\n" + value + "\n" + tag
+}
+
+// Report whether any line of s, ignoring surrounding whitespace, is line
+func hasLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// QuoteEnvValue returns value as it should be written after KEY= so that
+// SplitEnvLine reads it back unchanged. Most values are written bare; ones
+// with surrounding whitespace, line breaks or their own surrounding quotes
+// are double-quoted with escapes.
+func QuoteEnvValue(value string) string {
+	if strings.TrimSpace(value) == value && !strings.ContainsAny(value, "\r\n") && UnquoteEnvValue(value) == value {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// SectionHeader recognizes an INI-style [section] header, which starts a
+// new section of keys that runs until the next header
+func SectionHeader(line string) (name string, ok bool) {
+	line = strings.TrimSpace(line)
+	if len(line) < 3 || line[0] != '[' || line[len(line)-1] != ']' {
+		return "", false
+	}
+	name = strings.TrimSpace(line[1 : len(line)-1])
+	return name, name != ""
+}
+
+// ParseEnv returns the variables defined in decrypted secrets. Sections are
+// flattened and the last definition of a key wins, as when activated.
+func ParseEnv(content []byte) map[string]string {
+	env := make(map[string]string)
+	for _, line := range SplitEnvLines(content) {
+		if _, ok := SectionHeader(line); ok {
+			continue
+		}
+		if key, value, ok := SplitEnvLine(line); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// FormatEnv writes env as KEY=value lines sorted by key
+func FormatEnv(env map[string]string) []byte {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		b.WriteString(FormatEnvLine(key, env[key]) + "\n")
+	}
+	return b.Bytes()
+}
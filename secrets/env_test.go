@@ -0,0 +1,56 @@
+package secrets
+
+import "testing"
+
+func TestUnquoteEnvValue(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		// Unquoted
+		{`bar`, `bar`},
+		{`bar baz`, `bar baz`},
+		{``, ``},
+		// Wholly quoted
+		{`"bar"`, `bar`},
+		{`'bar'`, `bar`},
+		{`"value with spaces"`, `value with spaces`},
+		{`""`, ``},
+		{`''`, ``},
+		{`"a\nb"`, "a\nb"},
+		{`"a\tb\rc"`, "a\tb\rc"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"C:\\dir"`, `C:\dir`},
+		{`"\d\"`, `\d\`}, // Unknown escape and a trailing backslash are literal
+		{`'a\nb'`, `a\nb`},
+		{`'say "hi"'`, `say "hi"`},
+		// Partially quoted or mismatched, kept as is
+		{`"bar`, `"bar`},
+		{`bar"`, `bar"`},
+		{`a"b"`, `a"b"`},
+		{`"a"b`, `"a"b`},
+		{`"bar'`, `"bar'`},
+		{`'`, `'`},
+		{`"`, `"`},
+	}
+	for _, tt := range tests {
+		if got := UnquoteEnvValue(tt.value); got != tt.want {
+			t.Errorf("UnquoteEnvValue(%s) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// Whatever FormatEnvLine writes, SplitEnvLines and SplitEnvLine read back
+func TestFormatEnvLineRoundTrip(t *testing.T) {
+	for _, value := range []string{"", "bar", `"bar"`, "'bar'", "a b", "line1\nline2", "END\nx", "a\r\nb", `back\slash`} {
+		line := FormatEnvLine("KEY", value)
+		lines := SplitEnvLines([]byte(line))
+		if len(lines) != 1 {
+			t.Errorf("FormatEnvLine(%q) = %q splits into %d lines", value, line, len(lines))
+			continue
+		}
+		key, got, ok := SplitEnvLine(lines[0])
+		if !ok || key != "KEY" || got != value {
+			t.Errorf("FormatEnvLine(%q) = %q reads back as %q=%q (%v)", value, line, key, got, ok)
+		}
+	}
+}
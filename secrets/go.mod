@@ -4,7 +4,10 @@ go 1.21
 
 require (
 	filippo.io/age v1.2.0
+	github.com/fsnotify/fsnotify v1.9.0
 	golang.org/x/crypto v0.24.0
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
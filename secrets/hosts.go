@@ -0,0 +1,157 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// A recipient from the hosts file along with the fingerprint used to tell
+// keys apart (SHA256 for SSH keys, the recipient string for age keys)
+type Recipient struct {
+	Recipient   age.Recipient
+	Fingerprint string
+	Comment     string // SSH key comment, usually the hostname
+	Description string // Optional trailing "# description"
+	Tag         string // Tag naming an SSH key in age stanzas; empty for age1 keys
+	Groups      []string
+}
+
+// SplitHostLine splits a hosts file line into the key and an optional
+// trailing "# description". Only a '#' with whitespace on both sides (or
+// ending the line) starts a description, so key comments like user@host#2
+// are kept.
+func SplitHostLine(line string) (key, description string) {
+	for i := 1; i < len(line); i++ {
+		if line[i] != '#' || (line[i-1] != ' ' && line[i-1] != '\t') {
+			continue
+		}
+		if i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t' {
+			return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+	}
+	return strings.TrimSpace(line), ""
+}
+
+// NewSSHRecipient builds an age recipient from an SSH public key
+func NewSSHRecipient(pubKey ssh.PublicKey) (age.Recipient, error) {
+	recipient, err := agessh.NewRSARecipient(pubKey)
+	if err != nil {
+		// Try Ed25519
+		return agessh.NewEd25519Recipient(pubKey)
+	}
+	return recipient, nil
+}
+
+// HostGroups returns the groups named in a host's description with
+// "group:" words, e.g. "# laptop group:admins,work" is in admins and work
+func HostGroups(description string) []string {
+	var groups []string
+	for _, word := range strings.Fields(description) {
+		if !strings.HasPrefix(word, "group:") {
+			continue
+		}
+		for _, group := range strings.Split(strings.TrimPrefix(word, "group:"), ",") {
+			if group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// Plugin recipients are wrapped without any way to talk to the user, which
+// the plugins used for encryption (e.g. age-plugin-yubikey) don't need
+var pluginUI = &plugin.ClientUI{}
+
+// Parse a native age1 recipient, or a plugin one whose plugin is on PATH at
+// encryption time
+func parseAgeRecipient(s string) (age.Recipient, error) {
+	if recipient, err := age.ParseX25519Recipient(s); err == nil {
+		return recipient, nil
+	}
+	return plugin.NewRecipient(s, pluginUI)
+}
+
+// SSHTag returns the short key hash age writes in the stanza for an SSH
+// recipient, which is how a file's header names the keys it was encrypted to
+func SSHTag(pubKey ssh.PublicKey) string {
+	h := sha256.Sum256(pubKey.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4])
+}
+
+// ParseHosts parses the contents of a hosts file: one SSH public key or age1
+// recipient per line, with blank lines and # comments ignored. Lines that
+// can't be used are described in skipped rather than failing the parse.
+func ParseHosts(content []byte) (recipients []Recipient, skipped []string) {
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hostKey, description := SplitHostLine(line)
+
+		// Native age recipients (age1...) can decrypt with an age identity
+		// file; age1<name>1... recipients belong to an age-plugin-<name>
+		if strings.HasPrefix(hostKey, "age1") {
+			fields := strings.Fields(hostKey)
+			recipient, err := parseAgeRecipient(fields[0])
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("unparseable host on line %d: %s", i+1, line))
+				continue
+			}
+			recipients = append(recipients, Recipient{
+				Recipient:   recipient,
+				Fingerprint: fields[0],
+				Comment:     strings.Join(fields[1:], " "),
+				Description: description,
+				Groups:      HostGroups(description),
+			})
+			continue
+		}
+
+		// Parse SSH public key
+		pubKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("unparseable host on line %d: %s", i+1, line))
+			continue
+		}
+
+		recipient, err := NewSSHRecipient(pubKey)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("unsupported key type %s on line %d: %s", pubKey.Type(), i+1, line))
+			continue
+		}
+		recipients = append(recipients, Recipient{
+			Recipient:   recipient,
+			Fingerprint: ssh.FingerprintSHA256(pubKey),
+			Comment:     comment,
+			Description: description,
+			Tag:         SSHTag(pubKey),
+			Groups:      HostGroups(description),
+		})
+	}
+	return recipients, skipped
+}
+
+// LoadRecipients reads the hosts file at hostsPath. Any line that can't be
+// used is an error; call ParseHosts directly to skip such lines instead.
+func LoadRecipients(hostsPath string) ([]Recipient, error) {
+	content, err := os.ReadFile(hostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	recipients, skipped := ParseHosts(content)
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("invalid hosts file:\n  %s", strings.Join(skipped, "\n  "))
+	}
+	return recipients, nil
+}
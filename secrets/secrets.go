@@ -0,0 +1,305 @@
+// Package secrets reads and writes the age-encrypted KEY=value files managed
+// by the secrets command. Files are encrypted to every key listed in a hosts
+// file (SSH public keys or age1 recipients) and decrypted with an SSH private
+// key or age identity file.
+//
+// Nothing in this package prompts, prints or exits; failures are returned
+// as errors.
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// Decrypt decrypts secretsFile with the identities in identityPaths and
+// returns its variables
+func Decrypt(secretsFile string, identityPaths []string) (map[string]string, error) {
+	identities, err := LoadIdentities(identityPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := DecryptFile(secretsFile, identities...)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(content)
+
+	return ParseEnv(content), nil
+}
+
+// Encrypt writes env to secretsFile, encrypted to every host in hostsPath.
+// The caller's own key must be listed there to be able to decrypt again.
+func Encrypt(env map[string]string, secretsFile, hostsPath string) error {
+	hosts, err := LoadRecipients(hostsPath)
+	if err != nil {
+		return err
+	}
+
+	recipients := make([]age.Recipient, len(hosts))
+	for i, h := range hosts {
+		recipients[i] = h.Recipient
+	}
+
+	plaintext := FormatEnv(env)
+	defer clear(plaintext)
+	return EncryptFile(secretsFile, plaintext, recipients)
+}
+
+// LoadIdentities reads each path as an unencrypted SSH private key or an age
+// identity file. Passphrase-protected SSH keys are rejected since unlocking
+// them needs a prompt.
+func LoadIdentities(paths []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity: %w", err)
+		}
+
+		identity, err := agessh.ParseIdentity(content)
+		if err == nil {
+			identities = append(identities, identity)
+			continue
+		}
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("SSH key %s is passphrase protected", path)
+		}
+
+		ageIdentities, err := age.ParseIdentities(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither an SSH private key nor an age identity file", path)
+		}
+		identities = append(identities, ageIdentities...)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities given")
+	}
+	return identities, nil
+}
+
+// DecryptFile decrypts the file at path and returns the plaintext
+func DecryptFile(path string, identities ...age.Identity) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open secrets file: %w", err)
+	}
+	defer f.Close()
+
+	decrypted, err := DecryptReader(f, identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ReadAllAndZero(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decrypted content: %w", err)
+	}
+	return content, nil
+}
+
+// DecryptReader returns a reader of the plaintext of the age file in r,
+// which may be ASCII-armored. A *age.NoIdentityMatchError means none of
+// identities can decrypt it.
+func DecryptReader(r io.Reader, identities ...age.Identity) (io.Reader, error) {
+	return age.Decrypt(Unarmor(r), identities...)
+}
+
+// EncryptFile encrypts plaintext to recipients and atomically replaces the
+// file at path with the result
+func EncryptFile(path string, plaintext []byte, recipients []age.Recipient) error {
+	return encryptFile(path, plaintext, recipients, false)
+}
+
+// EncryptFileArmored is EncryptFile with ASCII-armored (PEM) output, for
+// places that mangle binary files
+func EncryptFileArmored(path string, plaintext []byte, recipients []age.Recipient) error {
+	return encryptFile(path, plaintext, recipients, true)
+}
+
+func encryptFile(path string, plaintext []byte, recipients []age.Recipient, armored bool) error {
+	// Encrypt into a temp file and only replace path once it's complete
+	return WriteFileAtomic(path, 0644, func(out io.Writer) error {
+		w, err := EncryptWriter(out, recipients, armored)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return fmt.Errorf("failed to write encrypted data: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to close encrypted writer: %w", err)
+		}
+		return nil
+	})
+}
+
+// EncryptWriter returns a writer that encrypts what's written to it for
+// recipients into w, ASCII-armored if armored. The file is only complete
+// once Close returns; Close doesn't close w.
+func EncryptWriter(w io.Writer, recipients []age.Recipient, armored bool) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt to")
+	}
+	if !armored {
+		return encryptWriter(w, recipients)
+	}
+	armorWriter := armor.NewWriter(w)
+	encrypted, err := encryptWriter(armorWriter, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return armoredWriter{encrypted, armorWriter}, nil
+}
+
+func encryptWriter(w io.Writer, recipients []age.Recipient) (io.WriteCloser, error) {
+	encrypted, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encrypted writer: %w", err)
+	}
+	return encrypted, nil
+}
+
+// An age writer inside an armor writer, closing both in order
+type armoredWriter struct {
+	io.WriteCloser
+	armor io.WriteCloser
+}
+
+func (w armoredWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.armor.Close()
+}
+
+// Unarmor returns a reader of the binary age file in r, decoding ASCII
+// armor if r starts with the armor header and passing it through if not
+func Unarmor(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if startsArmored(br) {
+		return armor.NewReader(br)
+	}
+	return br
+}
+
+// IsArmored reports whether the age file at path is ASCII-armored
+func IsArmored(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return startsArmored(bufio.NewReader(f)), nil
+}
+
+// Look for the armor header, after any leading whitespace, without
+// consuming anything
+func startsArmored(br *bufio.Reader) bool {
+	peeked, _ := br.Peek(len(armor.Header) + 64)
+	return bytes.HasPrefix(bytes.TrimLeft(peeked, " \t\r\n"), []byte(armor.Header))
+}
+
+// A recipient stanza from an age file header: its type (X25519, ssh-ed25519,
+// ssh-rsa, ...) and arguments. For SSH stanzas the first argument is the
+// key's tag (see SSHTag).
+type Stanza struct {
+	Type string
+	Args []string
+}
+
+// ReadStanzas returns the recipient stanzas in the header of the age file at
+// path. Nothing is decrypted, so it works without any identity.
+func ReadStanzas(path string) ([]Stanza, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open secrets file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(Unarmor(f))
+	if !scanner.Scan() || scanner.Text() != "age-encryption.org/v1" {
+		return nil, fmt.Errorf("%s is not an age file", path)
+	}
+	var stanzas []Stanza
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "---") {
+			return stanzas, nil
+		}
+		// Lines that don't start a stanza are the previous stanza's body
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "->" {
+			stanzas = append(stanzas, Stanza{Type: fields[1], Args: fields[2:]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s has a truncated age header", path)
+}
+
+// WriteFileAtomic writes a file by writing a temp file in the same
+// directory and renaming it into place, so a failure or crash never leaves
+// a truncated file behind
+func WriteFileAtomic(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	// No-op once the temp file has been renamed into place
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadAllAndZero is like io.ReadAll, but zeroes each buffer it outgrows so
+// the returned slice is the only copy of the data it leaves behind
+func ReadAllAndZero(r io.Reader) ([]byte, error) {
+	b := make([]byte, 0, 4096)
+	for {
+		if len(b) == cap(b) {
+			grown := make([]byte, len(b), 2*cap(b))
+			copy(grown, b)
+			clear(b)
+			b = grown
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			clear(b[:cap(b)])
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+)
+
+// Encrypt and Decrypt round-trip a set of variables with a throwaway key
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "testhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	hostsPath := filepath.Join(dir, "secrets.hosts")
+	secretsFile := filepath.Join(dir, "secrets.age")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hostsPath, ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{"FOO": "bar", "EMPTY": "", "SPACES": "a b c", "MULTI": "line1\nline2"}
+	if err := Encrypt(env, secretsFile, hostsPath); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	got, err := Decrypt(secretsFile, []string{keyPath})
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !reflect.DeepEqual(got, env) {
+		t.Errorf("Decrypt = %q, want %q", got, env)
+	}
+
+	// Another key can't decrypt
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPath := filepath.Join(dir, "identity.age")
+	if err := os.WriteFile(otherPath, []byte(other.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var noMatch *age.NoIdentityMatchError
+	if _, err := Decrypt(secretsFile, []string{otherPath}); !errors.As(err, &noMatch) {
+		t.Errorf("Decrypt with another key = %v, want a NoIdentityMatchError", err)
+	}
+}
+
+// EncryptWriter's output, armored or not, reads back through DecryptReader
+func TestEncryptWriterDecryptReader(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, armored := range []bool{false, true} {
+		var encrypted bytes.Buffer
+		w, err := EncryptWriter(&encrypted, []age.Recipient{identity.Recipient()}, armored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("FOO=bar\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.HasPrefix(encrypted.Bytes(), []byte("-----BEGIN AGE ENCRYPTED FILE-----")); got != armored {
+			t.Errorf("armored = %v, but output starts with %q", armored, encrypted.Bytes()[:20])
+		}
+
+		r, err := DecryptReader(&encrypted, identity)
+		if err != nil {
+			t.Fatalf("DecryptReader (armored %v): %v", armored, err)
+		}
+		plaintext, err := ReadAllAndZero(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != "FOO=bar\n" {
+			t.Errorf("DecryptReader (armored %v) = %q, want %q", armored, plaintext, "FOO=bar\n")
+		}
+	}
+
+	if _, err := EncryptWriter(&bytes.Buffer{}, nil, false); err == nil {
+		t.Error("EncryptWriter with no recipients succeeded")
+	}
+}